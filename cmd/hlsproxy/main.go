@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"time"
 
 	"github.com/meanii/hlsproxy/config"
+	"github.com/meanii/hlsproxy/internal/janitor"
 	"github.com/meanii/hlsproxy/internal/server"
+	"github.com/meanii/hlsproxy/internal/tracing"
+	"github.com/meanii/hlsproxy/internal/transcoder"
+	"github.com/meanii/hlsproxy/internal/webhook"
 	"github.com/meanii/hlsproxy/pkg/logger"
 	"github.com/meanii/hlsproxy/pkg/shutdown"
+	"go.uber.org/zap"
 )
 
 func main() {
@@ -20,10 +27,35 @@ func main() {
 
 	shutdown.EnableGrafullyShutdown()
 
+	stopTracing, err := tracing.Setup(context.Background())
+	if err != nil {
+		zap.S().Fatalf("failed to set up tracing, Error: %s", err)
+	}
+	shutdown.OnShutdown(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stopTracing(ctx)
+	})
+
+	// notifying the control plane of stream events
+	webhook.Start(context.Background())
+
+	// bounding disk usage of the output dir, failed streams included
+	janitor.Start(context.Background(), func(id string) bool {
+		tsc, ok := transcoder.Lookup(id)
+		return ok && !tsc.Failed()
+	})
+
 	httpServer := server.NewServer(*addr)
 
 	// adding routers
 	httpServer.AddRtmpRouter()
+	httpServer.AddStreamsRouter()
+	httpServer.AddIngestRouter()
+	httpServer.AddMetricsRouter()
+	httpServer.AddHealthRouter()
+	httpServer.AddWebhookRouter()
+	httpServer.AddEventsRouter()
 	httpServer.AddHlsRouter()
 	httpServer.AddFSServerRouter()
 	httpServer.StartAndListen()
@@ -6,7 +6,9 @@ import (
 	"os"
 	"path"
 	"sync"
+	"time"
 
+	"github.com/meanii/hlsproxy/internal/events"
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v3"
 )
@@ -19,19 +21,120 @@ type GlobalConfig struct {
 			URL string `yaml:"url"`
 		} `yaml:"origin_server"`
 		Ffmpeg struct {
-			Bin   string `yaml:"bin"`
-			Codec struct {
+			Bin string `yaml:"bin"`
+			// Encoder is the registered encoder used by streams that don't pick one.
+			Encoder string `yaml:"encoder"`
+			Codec   struct {
 				Video string `yaml:"video"`
 				Audio string `yaml:"audio"`
 			} `yaml:"codec"`
 			Variants []string `yaml:"variant"`
+			// MaxStreams caps the concurrent streams of the node, 0 is unlimited.
+			MaxStreams int `yaml:"max_streams"`
+			Restart    struct {
+				InitialDelay time.Duration `yaml:"initial_delay"`
+				MaxDelay     time.Duration `yaml:"max_delay"`
+				Multiplier   float64       `yaml:"multiplier"`
+				Jitter       float64       `yaml:"jitter"`
+				MaxRestarts  int           `yaml:"max_restarts"`
+				Window       time.Duration `yaml:"window"`
+			} `yaml:"restart"`
+			// Readiness bounds how long a new stream may take to be playable.
+			Readiness struct {
+				Timeout     time.Duration `yaml:"timeout"`
+				MinSegments int           `yaml:"min_segments"`
+			} `yaml:"readiness"`
+			// Watchdog acts on live streams that stall or carry broken content.
+			Watchdog struct {
+				StallTimeout time.Duration `yaml:"stall_timeout"`
+				// OnStall and OnDetect are restart, degrade or ignore.
+				OnStall string `yaml:"on_stall"`
+				// Detect runs the black, freeze and silence detectors of ffmpeg.
+				Detect         []string      `yaml:"detect"`
+				DetectDuration time.Duration `yaml:"detect_duration"`
+				OnDetect       string        `yaml:"on_detect"`
+			} `yaml:"watchdog"`
+			// Slate is the image or clip streams loop, with silent audio,
+			// while none of their sources is available.
+			Slate string `yaml:"slate"`
+			// Failover switches streams with backup sources back to the
+			// primary one once it's reachable again.
+			Failover struct {
+				ReturnToPrimary bool          `yaml:"return_to_primary"`
+				ProbeInterval   time.Duration `yaml:"probe_interval"`
+			} `yaml:"failover"`
+			Logs struct {
+				BufferLines int    `yaml:"buffer_lines"`
+				Dirname     string `yaml:"dirname"`
+				MaxSize     int64  `yaml:"max_size"`
+				MaxBackups  int    `yaml:"max_backups"`
+			} `yaml:"logs"`
 		} `yaml:"ffmpeg"`
 		Output struct {
 			Dirname string `yaml:"dirname"`
+			// BaseURL is where players fetch objects of the local storage from.
+			BaseURL string `yaml:"base_url"`
+			Storage struct {
+				Type   string   `yaml:"type"`
+				S3     S3Config `yaml:"s3"`
+				Memory struct {
+					// Capacity is the maximum size of the in-memory store, in
+					// bytes. The output is always ingested with this storage.
+					Capacity int64 `yaml:"capacity"`
+				} `yaml:"memory"`
+			} `yaml:"storage"`
+			// Ingest makes ffmpeg PUT its hls output to the proxy instead of
+			// writing to Dirname itself.
+			Ingest struct {
+				Enabled bool   `yaml:"enabled"`
+				URL     string `yaml:"url"`
+			} `yaml:"ingest"`
+			// Retention bounds the disk usage of Dirname, zero values disable a limit.
+			Retention struct {
+				Interval    time.Duration `yaml:"interval"`
+				MaxAge      time.Duration `yaml:"max_age"`
+				StreamQuota int64         `yaml:"stream_quota"`
+				GlobalQuota int64         `yaml:"global_quota"`
+			} `yaml:"retention"`
 		} `yaml:"output"`
+		Tracing struct {
+			Enabled bool `yaml:"enabled"`
+			// Exporter is otlp, sending over http to Endpoint.
+			Exporter    string            `yaml:"exporter"`
+			Endpoint    string            `yaml:"endpoint"`
+			Insecure    bool              `yaml:"insecure"`
+			Headers     map[string]string `yaml:"headers"`
+			ServiceName string            `yaml:"service_name"`
+			SampleRatio float64           `yaml:"sample_ratio"`
+		} `yaml:"tracing"`
+		Webhooks []WebhookConfig `yaml:"webhooks"`
 	} `yaml:"config"`
 }
 
+// WebhookConfig is an endpoint notified of stream events.
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+	// Events filters the event types sent, lifecycle events when empty.
+	Events []string `yaml:"events"`
+	// Secret signs the payloads with HMAC-SHA256, unsigned when empty.
+	Secret     string        `yaml:"secret"`
+	MaxRetries int           `yaml:"max_retries"`
+	Timeout    time.Duration `yaml:"timeout"`
+}
+
+// S3Config configures an S3-compatible segment storage.
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	UseSSL    bool   `yaml:"use_ssl"`
+	// PublicURL is where players fetch the objects from, e.g. a CDN.
+	PublicURL string `yaml:"public_url"`
+}
+
 var (
 	GlobalConfigInstance *GlobalConfig
 	once                 sync.Once
@@ -82,5 +185,20 @@ func (gc *GlobalConfig) unmarshel(config []byte) *GlobalConfig {
 	if err != nil {
 		zap.S().Fatalf("failed to decode yaml, Error: %s", err)
 	}
+	if err := cnf.validate(); err != nil {
+		zap.S().Fatalf("invalid config, Error: %s", err)
+	}
 	return &cnf
 }
+
+// validate rejects settings that would otherwise be silently ignored.
+func (gc *GlobalConfig) validate() error {
+	for _, hook := range gc.Config.Webhooks {
+		for _, name := range hook.Events {
+			if !events.Type(name).Known() {
+				return fmt.Errorf("webhook %s: unknown event %q, known events: %v", hook.URL, name, events.Types)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestValidateWebhookEvents(t *testing.T) {
+	tests := []struct {
+		name    string
+		events  []string
+		wantErr bool
+	}{
+		{name: "lifecycle default", events: nil},
+		{name: "known events", events: []string{"stream.live", "segment.created", "capacity.changed"}},
+		{name: "typo", events: []string{"stream.live", "stream.stoped"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		cfg := &GlobalConfig{}
+		cfg.Config.Webhooks = []WebhookConfig{{URL: "https://control-plane.example.com/hooks", Events: tt.events}}
+		if err := cfg.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validate() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
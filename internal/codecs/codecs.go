@@ -0,0 +1,104 @@
+// Package codecs computes RFC 6381 codec strings, as used by the CODECS
+// attribute of HLS master playlists, from encoder parameters.
+package codecs
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// H.264 profile_idc values.
+const (
+	AVCBaseline = 66
+	AVCMain     = 77
+	AVCHigh     = 100
+)
+
+// HEVC general_profile_idc values.
+const (
+	HEVCMain   = 1
+	HEVCMain10 = 2
+)
+
+// MPEG-4 audio object types.
+const (
+	AACLC   = 2
+	HEAAC   = 5
+	HEAACv2 = 29
+)
+
+// Codecs of audio streams without parameters.
+const (
+	AC3  = "ac-3"
+	EAC3 = "ec-3"
+	Opus = "opus"
+)
+
+// mp4aMPEG4Audio is the object type indication of MPEG-4 audio.
+const mp4aMPEG4Audio = 0x40
+
+// AVC returns avc1.PPCCLL for an H.264 stream. The constraint flags are the
+// ones x264 writes for the profile: baseline is signalled as constrained.
+func AVC(profileIDC int, level int) string {
+	var constraints int
+	switch profileIDC {
+	case AVCBaseline:
+		constraints = 0xc0
+	case AVCMain:
+		constraints = 0x40
+	}
+	return fmt.Sprintf("avc1.%02x%02x%02x", profileIDC, constraints, level)
+}
+
+// HEVC returns the codec of an HEVC stream with the given sample entry
+// (hvc1 or hev1), general_profile_idc and level (major*10+minor).
+func HEVC(sampleEntry string, profileIDC int, level int, highTier bool) string {
+	// every profile is compatible with itself, Main with Main10 as well
+	compat := uint32(1) << (31 - profileIDC)
+	if profileIDC == HEVCMain {
+		compat |= 1 << (31 - HEVCMain10)
+	}
+	tier := "L"
+	if highTier {
+		tier = "H"
+	}
+	// general_level_idc is 30 times the level, constraint byte B0 means
+	// progressive, non-packed, frame-only source
+	return fmt.Sprintf("%s.%d.%X.%s%d.B0", sampleEntry, profileIDC, bits.Reverse32(compat), tier, level*3)
+}
+
+// AV1 returns av01.P.LLT.DD for an AV1 stream. level is major*10+minor.
+func AV1(profile int, level int, highTier bool, bitDepth int) string {
+	tier := "M"
+	if highTier {
+		tier = "H"
+	}
+	seqLevelIdx := (level/10-2)*4 + level%10
+	return fmt.Sprintf("av01.%d.%02d%s.%02d", profile, seqLevelIdx, tier, bitDepth)
+}
+
+// VP9 returns vp09.PP.LL.DD for a VP9 stream. level is major*10+minor.
+func VP9(profile int, level int, bitDepth int) string {
+	return fmt.Sprintf("vp09.%02d.%02d.%02d", profile, level, bitDepth)
+}
+
+// MP4A returns the codec of an MPEG-4 audio stream, e.g. mp4a.40.2 for AAC-LC.
+func MP4A(objectType int) string {
+	return fmt.Sprintf("mp4a.%x.%d", mp4aMPEG4Audio, objectType)
+}
+
+// Join combines the codecs of every stream of a variant, skipping empty ones
+// and duplicates, in the order given.
+func Join(codecs ...string) string {
+	out := make([]string, 0, len(codecs))
+	seen := make(map[string]bool, len(codecs))
+	for _, codec := range codecs {
+		if codec == "" || seen[codec] {
+			continue
+		}
+		seen[codec] = true
+		out = append(out, codec)
+	}
+	return strings.Join(out, ",")
+}
@@ -0,0 +1,169 @@
+// Package encoder defines the video encoders the transcoder can use and a
+// registry to plug in new ones, e.g. hardware encoders or encoders running
+// on other hosts, without touching the command generation.
+package encoder
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Codec is a video codec an encoder can produce.
+type Codec string
+
+const (
+	H264 Codec = "h264"
+	H265 Codec = "h265"
+	AV1  Codec = "av1"
+	VP9  Codec = "vp9"
+)
+
+// DefaultName is the encoder used when none is configured.
+const DefaultName = "software"
+
+// Rendition describes a single video rendition of the ladder.
+type Rendition struct {
+	Codec     Codec
+	Width     int
+	Height    int
+	Bitrate   int // kbps
+	FrameRate float64
+	GOP       int // frames between keyframes
+	// SegmentDuration is the hls segment length in seconds, keyframes must
+	// land on every segment boundary.
+	SegmentDuration int
+}
+
+// Encoder produces the ffmpeg options encoding a rendition.
+type Encoder interface {
+	// Name identifies the encoder in the config and API.
+	Name() string
+	// Codecs lists the codecs the encoder can produce.
+	Codecs() []Codec
+	// Args returns the output options encoding the mapped video stream
+	// of a rendition, rate control and keyframe placement included.
+	Args(r Rendition) ([]string, error)
+	// CodecString returns the RFC 6381 codec the rendition is encoded as.
+	CodecString(r Rendition) string
+	// Probe returns the codecs the encoder can actually produce with the
+	// given ffmpeg binary on this node.
+	Probe(ffmpegBin string) ([]Codec, error)
+}
+
+// CommandWrapper is implemented by encoders that need to run ffmpeg in a
+// different way, e.g. on another host. Wrap receives the full argument
+// list, the binary first, and returns the one to execute.
+type CommandWrapper interface {
+	Wrap(argv []string) []string
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Encoder)
+
+	probeMu sync.Mutex
+	probes  = make(map[string]*probe)
+)
+
+// probe is the probe of an encoder with a binary, done is closed once
+// codecs and err are set.
+type probe struct {
+	done   chan struct{}
+	codecs []Codec
+	err    error
+}
+
+// Register makes an encoder available by its name. Registering the same
+// name twice replaces the previous encoder.
+func Register(e Encoder) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[e.Name()] = e
+}
+
+// Lookup returns the encoder registered with name.
+func Lookup(name string) (Encoder, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	e, ok := registry[name]
+	return e, ok
+}
+
+// Names returns the names of every registered encoder, sorted.
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Select returns the encoder called name, falling back to DefaultName when
+// name is empty, and checks it supports codec and that its probe found it
+// available. Successful probes are cached per encoder and binary, failed
+// ones are run again by the next call.
+func Select(name string, codec Codec, ffmpegBin string) (Encoder, error) {
+	if name == "" {
+		name = DefaultName
+	}
+	e, ok := Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown encoder %q, available: %v", name, Names())
+	}
+	if !Supports(e, codec) {
+		return nil, fmt.Errorf("encoder %s doesn't support %s", name, codec)
+	}
+
+	available, err := probeEncoder(e, ffmpegBin)
+	if err != nil {
+		return nil, fmt.Errorf("encoder %s is unavailable: %w", name, err)
+	}
+	if !contains(available, codec) {
+		return nil, fmt.Errorf("encoder %s can't produce %s with %s", name, codec, ffmpegBin)
+	}
+	return e, nil
+}
+
+// probeEncoder probes e with ffmpegBin once, concurrent callers waiting
+// for the same probe instead of running their own.
+func probeEncoder(e Encoder, ffmpegBin string) ([]Codec, error) {
+	key := e.Name() + "\x00" + ffmpegBin
+	probeMu.Lock()
+	p, running := probes[key]
+	if running {
+		probeMu.Unlock()
+		<-p.done
+		return p.codecs, p.err
+	}
+	p = &probe{done: make(chan struct{})}
+	probes[key] = p
+	probeMu.Unlock()
+
+	p.codecs, p.err = e.Probe(ffmpegBin)
+	if p.err != nil {
+		// ffmpeg may be installed or fixed by the next call
+		probeMu.Lock()
+		delete(probes, key)
+		probeMu.Unlock()
+	}
+	close(p.done)
+	return p.codecs, p.err
+}
+
+// Supports reports whether e can produce codec.
+func Supports(e Encoder, codec Codec) bool {
+	return contains(e.Codecs(), codec)
+}
+
+func contains(list []Codec, codec Codec) bool {
+	for _, c := range list {
+		if c == codec {
+			return true
+		}
+	}
+	return false
+}
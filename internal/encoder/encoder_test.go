@@ -0,0 +1,88 @@
+package encoder
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeEncoder counts its probes, which fail while fail is set.
+type fakeEncoder struct {
+	name   string
+	probes atomic.Int32
+	fail   atomic.Bool
+	delay  time.Duration
+}
+
+func (f *fakeEncoder) Name() string                     { return f.name }
+func (f *fakeEncoder) Codecs() []Codec                  { return []Codec{H264} }
+func (f *fakeEncoder) Args(Rendition) ([]string, error) { return nil, nil }
+func (f *fakeEncoder) CodecString(Rendition) string     { return "" }
+
+func (f *fakeEncoder) Probe(string) ([]Codec, error) {
+	f.probes.Add(1)
+	time.Sleep(f.delay)
+	if f.fail.Load() {
+		return nil, errors.New("ffmpeg not found")
+	}
+	return []Codec{H264}, nil
+}
+
+func TestSelectRetriesFailedProbes(t *testing.T) {
+	fake := &fakeEncoder{name: "fake-retry"}
+	Register(fake)
+	fake.fail.Store(true)
+
+	if _, err := Select(fake.name, H264, "ffmpeg"); err == nil {
+		t.Fatal("Select() succeeded with a failing probe")
+	}
+	fake.fail.Store(false)
+	for i := 0; i < 3; i++ {
+		if _, err := Select(fake.name, H264, "ffmpeg"); err != nil {
+			t.Fatalf("Select() error = %v once the probe succeeds", err)
+		}
+	}
+	// the failure was probed again, the success only once
+	if n := fake.probes.Load(); n != 2 {
+		t.Errorf("probed %d times, want 2", n)
+	}
+}
+
+func TestSelectProbesOnceConcurrently(t *testing.T) {
+	fake := &fakeEncoder{name: "fake-concurrent", delay: 50 * time.Millisecond}
+	Register(fake)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := Select(fake.name, H264, "ffmpeg"); err != nil {
+				t.Errorf("Select() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := fake.probes.Load(); n != 1 {
+		t.Errorf("probed %d times, want 1", n)
+	}
+}
+
+func TestSelectDoesNotSerializeEncoders(t *testing.T) {
+	slow := &fakeEncoder{name: "fake-slow", delay: time.Second}
+	fast := &fakeEncoder{name: "fake-fast"}
+	Register(slow)
+	Register(fast)
+
+	go Select(slow.name, H264, "ffmpeg") //nolint:errcheck
+	time.Sleep(50 * time.Millisecond)
+	started := time.Now()
+	if _, err := Select(fast.name, H264, "ffmpeg"); err != nil {
+		t.Fatalf("Select() error = %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 500*time.Millisecond {
+		t.Errorf("Select() of another encoder waited %s for a running probe", elapsed)
+	}
+}
@@ -0,0 +1,181 @@
+package encoder
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/meanii/hlsproxy/internal/codecs"
+)
+
+func init() {
+	Register(Software{})
+}
+
+// Software encodes on the CPU of the proxy node with libx264, libx265,
+// libsvtav1 and libvpx-vp9.
+type Software struct{}
+
+// libraries maps each codec to the ffmpeg encoder producing it.
+var libraries = map[Codec]string{
+	H264: "libx264",
+	H265: "libx265",
+	AV1:  "libsvtav1",
+	VP9:  "libvpx-vp9",
+}
+
+// levelsByHeight maps a rendition height to the lowest level able to carry
+// it at up to 30fps, per codec. Levels are major*10+minor, entries are
+// ordered by height.
+var levelsByHeight = map[Codec][]struct {
+	height int
+	level  int
+}{
+	H264: {{360, 30}, {480, 31}, {720, 31}, {1080, 40}, {1440, 50}, {2160, 51}},
+	H265: {{480, 30}, {720, 31}, {1080, 40}, {1440, 50}, {2160, 50}},
+	AV1:  {{240, 20}, {360, 21}, {480, 30}, {720, 31}, {1080, 40}, {2160, 50}},
+	VP9:  {{240, 20}, {360, 21}, {480, 30}, {720, 31}, {1080, 40}, {2160, 50}},
+}
+
+// Level returns the level of codec for a rendition height, major*10+minor.
+func Level(codec Codec, height int) int {
+	levels := levelsByHeight[codec]
+	if len(levels) == 0 {
+		return 0
+	}
+	for _, l := range levels {
+		if height <= l.height {
+			return l.level
+		}
+	}
+	return levels[len(levels)-1].level
+}
+
+// H264Profile returns the H.264 profile used for a rendition height.
+func H264Profile(height int) string {
+	if height >= 720 {
+		return "high"
+	}
+	return "main"
+}
+
+func levelString(level int) string {
+	return fmt.Sprintf("%d.%d", level/10, level%10)
+}
+
+func (Software) Name() string {
+	return DefaultName
+}
+
+func (Software) Codecs() []Codec {
+	return []Codec{H264, H265, AV1, VP9}
+}
+
+func (Software) Args(r Rendition) ([]string, error) {
+	library, ok := libraries[r.Codec]
+	if !ok {
+		return nil, fmt.Errorf("unsupported codec %s", r.Codec)
+	}
+	level := Level(r.Codec, r.Height)
+
+	args := []string{"-c:v", library}
+	switch r.Codec {
+	case H265:
+		args = append(args,
+			"-preset", "veryfast",
+			"-profile:v", "main",
+			"-a53cc", "1",
+			"-x265-params", "level-idc="+levelString(level),
+			// Apple players only accept HEVC signalled as hvc1
+			"-tag:v", "hvc1",
+		)
+	case AV1:
+		args = append(args,
+			"-preset", "10",
+			// libsvtav1 takes the level as major*10+minor
+			"-level:v", strconv.Itoa(level),
+			"-tag:v", "av01",
+		)
+	case VP9:
+		args = append(args,
+			"-profile:v", "0",
+			"-level:v", levelString(level),
+			"-deadline", "realtime", "-cpu-used", "8", "-row-mt", "1",
+			"-tag:v", "vp09",
+		)
+	default:
+		args = append(args,
+			"-preset", "veryfast",
+			"-profile:v", H264Profile(r.Height),
+			"-level:v", levelString(level),
+			// keep CEA-608/708 captions from the source
+			"-a53cc", "1",
+		)
+	}
+	return append(args, RateControlArgs(r)...), nil
+}
+
+// RateControlArgs returns the bitrate and keyframe options shared by every
+// ffmpeg encoder: constrained bitrate and fixed GOPs aligned on segments.
+func RateControlArgs(r Rendition) []string {
+	bitrate := strconv.Itoa(r.Bitrate) + "k"
+	bufsize := strconv.Itoa(2*r.Bitrate) + "k"
+	gop := strconv.Itoa(r.GOP)
+	return []string{
+		"-b:v", bitrate, "-maxrate", bitrate, "-bufsize", bufsize,
+		"-g", gop, "-keyint_min", gop, "-sc_threshold", "0",
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", r.SegmentDuration),
+	}
+}
+
+func (Software) CodecString(r Rendition) string {
+	level := Level(r.Codec, r.Height)
+	switch r.Codec {
+	case H265:
+		return codecs.HEVC("hvc1", codecs.HEVCMain, level, false)
+	case AV1:
+		return codecs.AV1(0, level, false, 8)
+	case VP9:
+		return codecs.VP9(0, level, 8)
+	}
+	profiles := map[string]int{
+		"baseline": codecs.AVCBaseline,
+		"main":     codecs.AVCMain,
+		"high":     codecs.AVCHigh,
+	}
+	return codecs.AVC(profiles[H264Profile(r.Height)], level)
+}
+
+// Probe returns the codecs whose library ffmpeg was built with.
+func (s Software) Probe(ffmpegBin string) ([]Codec, error) {
+	available, err := ListEncoders(ffmpegBin)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]Codec, 0, len(libraries))
+	for _, codec := range s.Codecs() {
+		if available[libraries[codec]] {
+			found = append(found, codec)
+		}
+	}
+	return found, nil
+}
+
+// ListEncoders returns the encoders ffmpegBin was built with.
+func ListEncoders(ffmpegBin string) (map[string]bool, error) {
+	out, err := exec.Command(ffmpegBin, "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ffmpeg encoders: %w", err)
+	}
+
+	encoders := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		// lines look like " V....D libx264   libx264 H.264 / AVC ..."
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && len(fields[0]) == 6 {
+			encoders[fields[1]] = true
+		}
+	}
+	return encoders, nil
+}
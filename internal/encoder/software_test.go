@@ -0,0 +1,49 @@
+package encoder
+
+import (
+	"testing"
+)
+
+// levelArg returns the level option Args passed to the encoder.
+func levelArg(args []string) string {
+	for i := 0; i+1 < len(args); i++ {
+		switch args[i] {
+		case "-level:v":
+			return args[i+1]
+		case "-x265-params":
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+func TestSoftwareLevel(t *testing.T) {
+	tests := []struct {
+		codec  Codec
+		height int
+		level  string
+		codecs string
+	}{
+		{codec: H264, height: 360, level: "3.0", codecs: "avc1.4d401e"},
+		{codec: H264, height: 1080, level: "4.0", codecs: "avc1.640028"},
+		{codec: H265, height: 720, level: "level-idc=3.1", codecs: "hvc1.1.6.L93.B0"},
+		{codec: AV1, height: 360, level: "21", codecs: "av01.0.01M.08"},
+		{codec: AV1, height: 1080, level: "40", codecs: "av01.0.08M.08"},
+		{codec: VP9, height: 480, level: "3.0", codecs: "vp09.00.30.08"},
+		{codec: VP9, height: 2160, level: "5.0", codecs: "vp09.00.50.08"},
+	}
+	for _, tt := range tests {
+		r := Rendition{Codec: tt.codec, Height: tt.height, Bitrate: 1000, GOP: 60, SegmentDuration: 2}
+		args, err := Software{}.Args(r)
+		if err != nil {
+			t.Fatalf("%s %dp: Args() error = %v", tt.codec, tt.height, err)
+		}
+		// the CODECS level must be the one the encoder was told to produce
+		if got := levelArg(args); got != tt.level {
+			t.Errorf("%s %dp: level option = %q, want %q", tt.codec, tt.height, got, tt.level)
+		}
+		if got := (Software{}).CodecString(r); got != tt.codecs {
+			t.Errorf("%s %dp: CodecString() = %q, want %q", tt.codec, tt.height, got, tt.codecs)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Package events is an in-process bus for stream lifecycle events.
+package events
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Type names an event.
+type Type string
+
+const (
+	// StreamCreated is published when a stream was registered and ffmpeg started.
+	StreamCreated Type = "stream.created"
+	// StreamLive is published once every rendition of a stream has a segment.
+	StreamLive Type = "stream.live"
+	// StreamRestarted is published when ffmpeg exited and is about to be restarted.
+	StreamRestarted Type = "stream.restarted"
+	// StreamFailed is published when a stream gave up, crash looping or never ready.
+	StreamFailed Type = "stream.failed"
+	// StreamStopped is published when ffmpeg was stopped on request.
+	StreamStopped Type = "stream.stopped"
+	// StreamDegraded is published when the watchdog found a stream stalled
+	// or carrying black, frozen or silent content.
+	StreamDegraded Type = "stream.degraded"
+	// StreamRecovered is published when a degraded stream is healthy again.
+	StreamRecovered Type = "stream.recovered"
+	// StreamSourceSwitched is published when a stream fails over to another
+	// of its sources.
+	StreamSourceSwitched Type = "stream.source_switched"
+	// StreamProgress periodically carries the ffmpeg progress of a stream.
+	StreamProgress Type = "stream.progress"
+	// SegmentStalled is published when a live stream stopped producing segments.
+	SegmentStalled Type = "segment.stalled"
+	// SegmentCreated is published when a media segment was stored.
+	SegmentCreated Type = "segment.created"
+	// SegmentDeleted is published when a segment left the live window.
+	SegmentDeleted Type = "segment.deleted"
+	// PlaylistUpdated is published when a media playlist was rewritten.
+	PlaylistUpdated Type = "playlist.updated"
+	// CapacityChanged is published when streams are added or removed.
+	CapacityChanged Type = "capacity.changed"
+)
+
+// Types lists every event type published on the bus.
+var Types = []Type{
+	StreamCreated, StreamLive, StreamRestarted, StreamFailed, StreamStopped,
+	StreamDegraded, StreamRecovered, StreamSourceSwitched, StreamProgress,
+	SegmentStalled, SegmentCreated, SegmentDeleted, PlaylistUpdated, CapacityChanged,
+}
+
+// Known reports whether t is published on the bus.
+func (t Type) Known() bool {
+	for _, known := range Types {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is a single occurrence on a stream.
+type Event struct {
+	// Seq increases by one with every published event.
+	Seq      uint64         `json:"seq"`
+	Type     Type           `json:"type"`
+	StreamID string         `json:"stream_id,omitempty"`
+	Time     time.Time      `json:"time"`
+	Data     map[string]any `json:"data,omitempty"`
+}
+
+const (
+	defaultBuffer = 64
+	// historySize is the number of past events kept for resuming subscribers.
+	historySize = 1000
+)
+
+var (
+	mu          sync.Mutex
+	seq         uint64
+	history     []Event
+	subscribers = make(map[chan Event]struct{})
+)
+
+// Publish numbers e and sends it to every subscriber. It never blocks:
+// subscribers that fall behind miss the event.
+func Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	seq++
+	e.Seq = seq
+	history = append(history, e)
+	if len(history) > historySize {
+		history = history[len(history)-historySize:]
+	}
+
+	for ch := range subscribers {
+		select {
+		case ch <- e:
+		default:
+			zap.S().Debugf("events: dropping %s of stream %s for a slow subscriber", e.Type, e.StreamID)
+		}
+	}
+}
+
+// Subscribe returns a channel receiving every event published from now on,
+// buffering up to buffer events, and a function cancelling the subscription.
+func Subscribe(buffer int) (<-chan Event, func()) {
+	// no event is newer than the largest cursor
+	_, ch, cancel, _ := SubscribeFrom(^uint64(0), buffer)
+	return ch, cancel
+}
+
+// SubscribeFrom is like Subscribe, also returning the kept events published
+// after cursor. missed is true when events after cursor were already
+// dropped from the history.
+func SubscribeFrom(cursor uint64, buffer int) (past []Event, ch <-chan Event, cancel func(), missed bool) {
+	if buffer <= 0 {
+		buffer = defaultBuffer
+	}
+	c := make(chan Event, buffer)
+
+	mu.Lock()
+	for _, e := range history {
+		if e.Seq > cursor {
+			past = append(past, e)
+		}
+	}
+	missed = cursor < seq && (len(history) == 0 || history[0].Seq > cursor+1)
+	subscribers[c] = struct{}{}
+	mu.Unlock()
+
+	var once sync.Once
+	return past, c, func() {
+		once.Do(func() {
+			mu.Lock()
+			delete(subscribers, c)
+			mu.Unlock()
+			close(c)
+		})
+	}, missed
+}
+
+// Latest returns the sequence number of the last published event.
+func Latest() uint64 {
+	mu.Lock()
+	defer mu.Unlock()
+	return seq
+}
@@ -0,0 +1,95 @@
+package events
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// publish publishes n events of stream and returns the seq of the last one.
+func publish(n int, stream string) uint64 {
+	for i := 0; i < n; i++ {
+		Publish(Event{Type: SegmentCreated, StreamID: stream})
+	}
+	return Latest()
+}
+
+func seqs(events []Event) []uint64 {
+	var s []uint64
+	for _, e := range events {
+		s = append(s, e.Seq)
+	}
+	return s
+}
+
+func TestSubscribeFrom(t *testing.T) {
+	last := publish(5, "resume")
+	tests := []struct {
+		name       string
+		cursor     uint64
+		wantPast   []uint64
+		wantMissed bool
+	}{
+		{name: "inside the history", cursor: last - 2, wantPast: []uint64{last - 1, last}},
+		{name: "latest", cursor: last},
+		{name: "ahead of the bus", cursor: last + 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			past, _, cancel, missed := SubscribeFrom(tt.cursor, 0)
+			defer cancel()
+			if got := seqs(past); fmt.Sprint(got) != fmt.Sprint(tt.wantPast) {
+				t.Errorf("past = %v, want %v", got, tt.wantPast)
+			}
+			if missed != tt.wantMissed {
+				t.Errorf("missed = %v, want %v", missed, tt.wantMissed)
+			}
+		})
+	}
+}
+
+func TestSubscribeFromDroppedHistory(t *testing.T) {
+	last := publish(historySize+10, "dropped")
+	oldest := last - historySize + 1
+
+	past, _, cancel, missed := SubscribeFrom(oldest-2, 0)
+	cancel()
+	if !missed {
+		t.Error("missed = false resuming before the oldest kept event")
+	}
+	if len(past) != historySize || past[0].Seq != oldest || past[len(past)-1].Seq != last {
+		t.Errorf("past = %d events from %d, want the %d kept from %d", len(past), past[0].Seq, historySize, oldest)
+	}
+
+	// the event right after the cursor is still kept
+	past, _, cancel, missed = SubscribeFrom(oldest-1, 0)
+	cancel()
+	if missed || len(past) != historySize {
+		t.Errorf("resuming right before the oldest kept event missed = %v with %d past events, want none missed", missed, len(past))
+	}
+}
+
+func TestSubscribeFromLive(t *testing.T) {
+	cursor := publish(2, "live")
+	past, ch, cancel, _ := SubscribeFrom(cursor-1, 4)
+	defer cancel()
+	if len(past) != 1 {
+		t.Fatalf("%d past events, want 1", len(past))
+	}
+
+	// events published after subscribing come through the channel only
+	Publish(Event{Type: StreamLive, StreamID: "live"})
+	select {
+	case e := <-ch:
+		if e.Seq != cursor+1 || e.Type != StreamLive {
+			t.Errorf("received %s #%d, want %s #%d", e.Type, e.Seq, StreamLive, cursor+1)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no live event received")
+	}
+
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Error("the channel is open after cancelling")
+	}
+}
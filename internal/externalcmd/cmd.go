@@ -2,80 +2,170 @@
 package externalcmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sync"
 	"time"
+
+	"github.com/kballard/go-shellquote"
+	"go.uber.org/zap"
 )
 
 const (
-	restartPause = 5 * time.Second
+	// stderrTailLines is the number of stderr lines kept for each restart record.
+	stderrTailLines = 20
 )
 
 var errTerminated = errors.New("terminated")
 
+// ErrCrashLoop is set on the ExitResult passed to onExit when a command
+// exceeded its restart budget.
+var ErrCrashLoop = errors.New("command is crash looping")
+
+// State is the lifecycle state of a Cmd.
+type State int
+
+const (
+	StateRunning State = iota
+	StateRestarting
+	StateFailed
+	StateStopped
+)
+
+func (s State) String() string {
+	switch s {
+	case StateRunning:
+		return "running"
+	case StateRestarting:
+		return "restarting"
+	case StateFailed:
+		return "failed"
+	case StateStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
 // OnExitFunc is the prototype of onExit.
-type OnExitFunc func(error)
+type OnExitFunc func(ExitResult)
 
 // Environment is a Cmd environment.
 type Environment map[string]string
 
+// Output is where the standard streams of a Cmd are written.
+// Nil writers default to the proxy's own stdout and stderr.
+type Output struct {
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
 // Cmd is an external command.
 type Cmd struct {
+	ctx      context.Context
 	pool     *Pool
-	cmdstr   string
+	args     []string
 	restart  bool
+	policy   RestartPolicy
 	env      Environment
-	onExit   func(error)
+	output   Output
+	onExit   OnExitFunc
 	StreamID string
 
 	Process *os.Process
 
+	mu         sync.RWMutex
+	state      State
+	history    []RestartRecord
+	lastExit   *ExitResult
+	stderrTail *tailWriter
+	// restartRequested is set by Restart until the process exits
+	restartRequested bool
+
 	// in
 	terminate chan struct{}
-	cmdDone   chan int
+	closeOnce sync.Once
+	cmdDone   chan ExitResult
 }
 
-var GloblaActiveCmds = make(map[string]*Cmd)
+var (
+	activeMu   sync.Mutex
+	activeCmds = make(map[*Cmd]struct{})
+)
+
+// ActiveCmds returns the commands which didn't give up nor were closed yet.
+func ActiveCmds() []*Cmd {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	cmds := make([]*Cmd, 0, len(activeCmds))
+	for cmd := range activeCmds {
+		cmds = append(cmds, cmd)
+	}
+	return cmds
+}
 
-// NewCmd allocates a Cmd.
+// NewCmd allocates a Cmd running args, the binary first. The arguments are
+// passed to the process as they are, without any shell expansion.
 func NewCmd(
 	pool *Pool,
-	cmdstr string,
+	args []string,
 	restart bool,
+	policy RestartPolicy,
 	env Environment,
+	output Output,
 	onExit OnExitFunc,
 	streamId string,
 ) *Cmd {
-	// replace variables in both Linux and Windows, in order to allow using the
-	// same commands on both of them.
-	cmdstr = os.Expand(cmdstr, func(variable string) string {
-		if value, ok := env[variable]; ok {
-			return value
-		}
-		return os.Getenv(variable)
-	})
+	return NewCmdContext(context.Background(), pool, args, restart, policy, env, output, onExit, streamId)
+}
+
+// NewCmdContext is like NewCmd, recording the spawns of the process in
+// the trace of ctx. The context doesn't bound the command, use Close.
+func NewCmdContext(
+	ctx context.Context,
+	pool *Pool,
+	args []string,
+	restart bool,
+	policy RestartPolicy,
+	env Environment,
+	output Output,
+	onExit OnExitFunc,
+	streamId string,
+) *Cmd {
+	if output.Stdout == nil {
+		output.Stdout = os.Stdout
+	}
+	if output.Stderr == nil {
+		output.Stderr = os.Stderr
+	}
 
 	if onExit == nil {
-		onExit = func(_ error) {}
+		onExit = func(_ ExitResult) {}
 	}
 
 	e := &Cmd{
-		pool:      pool,
-		cmdstr:    cmdstr,
-		restart:   restart,
-		env:       env,
-		onExit:    onExit,
-		terminate: make(chan struct{}),
-		cmdDone:   make(chan int),
+		ctx:        ctx,
+		pool:       pool,
+		args:       args,
+		restart:    restart,
+		policy:     policy.withDefaults(),
+		env:        env,
+		output:     output,
+		onExit:     onExit,
+		StreamID:   streamId,
+		stderrTail: newTailWriter(stderrTailLines),
+		terminate:  make(chan struct{}),
+		cmdDone:    make(chan ExitResult),
 	}
 
-	pool.wg.Add(1)
+	activeMu.Lock()
+	activeCmds[e] = struct{}{}
+	activeMu.Unlock()
 
+	pool.wg.Add(1)
 	go e.run()
-
-	GloblaActiveCmds[streamId] = e
-
 	return e
 }
 
@@ -84,16 +174,22 @@ func (e *Cmd) SetStreamID(streamID string) {
 }
 
 func (e *Cmd) Done() {
-	e.cmdDone <- 0
+	e.cmdDone <- ExitResult{}
 }
 
-// Close closes the command. It doesn't wait for the command to exit.
+// Close closes the command. It doesn't wait for the command to exit and
+// may be called more than once.
 func (e *Cmd) Close() {
-	close(e.terminate)
+	e.closeOnce.Do(func() { close(e.terminate) })
 }
 
 func (e *Cmd) run() {
 	defer e.pool.wg.Done()
+	defer func() {
+		activeMu.Lock()
+		delete(activeCmds, e)
+		activeMu.Unlock()
+	}()
 
 	env := append([]string(nil), os.Environ()...)
 	for key, val := range e.env {
@@ -101,36 +197,154 @@ func (e *Cmd) run() {
 	}
 
 	for {
-		err := e.runOSSpecific(env)
-		if errors.Is(err, errTerminated) {
+		res := e.runOSSpecific(env)
+		e.setLastExit(res)
+		if errors.Is(res.Err, errTerminated) {
+			e.setState(StateStopped)
+			e.onExit(res)
 			return
 		}
 
 		if !e.restart {
-			if err != nil {
-				e.onExit(err)
-			}
+			e.setState(StateStopped)
+			e.onExit(res)
 			return
 		}
 
-		if err != nil {
-			e.onExit(err)
-		} else {
-			e.onExit(fmt.Errorf("command exited with code 0"))
+		if res.Err == nil {
+			res.Err = fmt.Errorf("command exited with code 0")
 		}
 
+		// onExit is called once per exit, with ErrCrashLoop when giving up
+		delay, ok := e.recordExit(res)
+		if !ok {
+			zap.S().Errorf("externalcmd: stream %s exceeded %d restarts within %s, giving up",
+				e.StreamID, e.policy.MaxRestarts, e.policy.Window)
+			res.Err = ErrCrashLoop
+			e.onExit(res)
+			return
+		}
+		e.onExit(res)
+		zap.S().Warnf("externalcmd: stream %s %s, restarting in %s", e.StreamID, res, delay)
+
 		select {
-		case <-time.After(restartPause):
+		case <-time.After(delay):
+			e.setState(StateRunning)
 		case <-e.terminate:
+			e.setState(StateStopped)
 			return
 		}
 	}
 }
 
+// recordExit appends a restart record and returns the pause before
+// the next attempt, or false if the command must not be restarted.
+// Requested restarts are recorded without delay nor counting against
+// the crash loop budget.
+func (e *Cmd) recordExit(res ExitResult) (time.Duration, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	attempt := restartsWithin(e.history, now, e.policy.Window) + 1
+
+	record := RestartRecord{
+		Time:   now,
+		Exit:   res,
+		Error:  res.Err.Error(),
+		Stderr: e.stderrTail.Flush(),
+	}
+
+	ok := res.Requested || e.policy.MaxRestarts < 0 || attempt <= e.policy.MaxRestarts
+	if ok {
+		if !res.Requested {
+			record.Delay = e.policy.delay(attempt)
+		}
+		e.state = StateRestarting
+	} else {
+		e.state = StateFailed
+	}
+
+	e.history = append(e.history, record)
+	if len(e.history) > maxRestartHistory {
+		e.history = e.history[len(e.history)-maxRestartHistory:]
+	}
+	return record.Delay, ok
+}
+
+// takeRestartRequest reports whether Restart caused the exit of the
+// current process, and resets it for the next one.
+func (e *Cmd) takeRestartRequest() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	requested := e.restartRequested
+	e.restartRequested = false
+	return requested
+}
+
+func (e *Cmd) setLastExit(res ExitResult) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lastExit = &res
+}
+
+// LastExit returns how the latest run of the command ended, or nil
+// if it is still on its first run.
+func (e *Cmd) LastExit() *ExitResult {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.lastExit == nil {
+		return nil
+	}
+	res := *e.lastExit
+	return &res
+}
+
+func (e *Cmd) setState(state State) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// a failed command stays failed
+	if e.state != StateFailed {
+		e.state = state
+	}
+}
+
+// State returns the current lifecycle state of the command.
+func (e *Cmd) State() State {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.state
+}
+
+// RestartHistory returns the most recent exits of the command, oldest first.
+func (e *Cmd) RestartHistory() []RestartRecord {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return append([]RestartRecord(nil), e.history...)
+}
+
+// GetCmdString returns the command line quoted for display only.
 func (e *Cmd) GetCmdString() string {
-	return e.cmdstr
+	return shellquote.Join(e.Args()...)
+}
+
+// Args returns the argument list of the command, the binary first.
+func (e *Cmd) Args() []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return append([]string(nil), e.args...)
+}
+
+// SetArgs replaces the argument list the command is restarted with.
+// The running process isn't affected.
+func (e *Cmd) SetArgs(args []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.args = append([]string(nil), args...)
 }
 
 func (e *Cmd) GetProcess() *os.Process {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 	return e.Process
 }
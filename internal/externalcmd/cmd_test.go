@@ -0,0 +1,361 @@
+//go:build !windows
+
+package externalcmd
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeCmdEnv makes the test binary behave as the fake command instead of
+// running the tests: exit:<code>, kill:<signal> or sleep.
+const fakeCmdEnv = "EXTERNALCMD_FAKE"
+
+func TestMain(m *testing.M) {
+	if behaviour, ok := os.LookupEnv(fakeCmdEnv); ok {
+		runFake(behaviour)
+	}
+	os.Exit(m.Run())
+}
+
+func runFake(behaviour string) {
+	name, value, _ := strings.Cut(behaviour, ":")
+	switch name {
+	case "exit":
+		code, _ := strconv.Atoi(value)
+		os.Exit(code)
+	case "kill":
+		signal, _ := strconv.Atoi(value)
+		syscall.Kill(os.Getpid(), syscall.Signal(signal)) //nolint:errcheck
+		time.Sleep(time.Minute)
+	case "sleep":
+		time.Sleep(time.Minute)
+	}
+	os.Exit(2)
+}
+
+// fastPolicy restarts right away, without jitter, so tests run quickly.
+var fastPolicy = RestartPolicy{
+	InitialDelay: time.Millisecond,
+	MaxDelay:     time.Second,
+	Multiplier:   2,
+	MaxRestarts:  -1,
+}
+
+// startFake runs the test binary as the fake command and returns the
+// results passed to onExit.
+func startFake(t *testing.T, behaviour string, restart bool, policy RestartPolicy) (*Cmd, *Pool, <-chan ExitResult) {
+	t.Helper()
+	exits := make(chan ExitResult, 16)
+	pool := NewPool()
+	cmd := NewCmd(pool, []string{os.Args[0], "-test.run=^$"}, restart, policy,
+		Environment{fakeCmdEnv: behaviour}, Output{Stdout: discard{}, Stderr: discard{}},
+		func(res ExitResult) { exits <- res }, t.Name())
+	return cmd, pool, exits
+}
+
+type discard struct{}
+
+func (discard) Write(p []byte) (int, error) { return len(p), nil }
+
+func nextExit(t *testing.T, exits <-chan ExitResult) ExitResult {
+	t.Helper()
+	select {
+	case res := <-exits:
+		return res
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the command to exit")
+	}
+	return ExitResult{}
+}
+
+// waitRunning waits for the process of the command to be started.
+func waitRunning(t *testing.T, cmd *Cmd) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for cmd.GetProcess() == nil || cmd.State() != StateRunning {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the command to start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// let the fake command get past its startup
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name      string
+		behaviour string
+		code      int
+		signal    string
+		success   bool
+	}{
+		{name: "success", behaviour: "exit:0", code: 0, success: true},
+		{name: "failure", behaviour: "exit:3", code: 3},
+		{name: "killed", behaviour: "kill:" + strconv.Itoa(int(syscall.SIGKILL)), code: -1, signal: syscall.SIGKILL.String()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, pool, exits := startFake(t, tt.behaviour, false, fastPolicy)
+			res := nextExit(t, exits)
+			pool.Close()
+
+			if res.Code != tt.code {
+				t.Errorf("Code = %d, want %d", res.Code, tt.code)
+			}
+			if res.Signal != tt.signal {
+				t.Errorf("Signal = %q, want %q", res.Signal, tt.signal)
+			}
+			if res.Success() != tt.success {
+				t.Errorf("Success() = %v, want %v, err: %v", res.Success(), tt.success, res.Err)
+			}
+			if res.Requested {
+				t.Error("Requested = true for an exit nobody asked for")
+			}
+			if cmd.State() != StateStopped {
+				t.Errorf("State = %s, want %s", cmd.State(), StateStopped)
+			}
+			if last := cmd.LastExit(); last == nil || last.Code != tt.code {
+				t.Errorf("LastExit = %+v, want code %d", last, tt.code)
+			}
+		})
+	}
+}
+
+func TestCloseIsRequested(t *testing.T) {
+	cmd, pool, exits := startFake(t, "sleep", true, fastPolicy)
+	waitRunning(t, cmd)
+	cmd.Close()
+	res := nextExit(t, exits)
+	pool.Close()
+
+	if !res.Requested || !res.Stopped() {
+		t.Errorf("Requested = %v, Stopped() = %v, want both true", res.Requested, res.Stopped())
+	}
+	if res.Signal != syscall.SIGINT.String() {
+		t.Errorf("Signal = %q, want %q", res.Signal, syscall.SIGINT.String())
+	}
+	if cmd.State() != StateStopped {
+		t.Errorf("State = %s, want %s", cmd.State(), StateStopped)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	cmd, pool, exits := startFake(t, "sleep", true, fastPolicy)
+	waitRunning(t, cmd)
+	cmd.Close()
+	cmd.Close()
+	if res := nextExit(t, exits); !res.Stopped() {
+		t.Errorf("exit after Close = %s, want stopped", res)
+	}
+	pool.Close()
+	cmd.Close()
+}
+
+func TestActiveCmds(t *testing.T) {
+	pool := NewPool()
+	cmds := make(chan *Cmd, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(cmds); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cmds <- NewCmd(pool, []string{os.Args[0], "-test.run=^$"}, true, fastPolicy,
+				Environment{fakeCmdEnv: "sleep"}, Output{Stdout: discard{}, Stderr: discard{}}, nil, "same-id")
+		}()
+	}
+	wg.Wait()
+	close(cmds)
+
+	active := make(map[*Cmd]bool)
+	for _, cmd := range ActiveCmds() {
+		active[cmd] = true
+	}
+	var started []*Cmd
+	for cmd := range cmds {
+		if !active[cmd] {
+			t.Error("a started command isn't active")
+		}
+		started = append(started, cmd)
+	}
+	for _, cmd := range started {
+		cmd.Close()
+	}
+	pool.Close()
+	for _, cmd := range ActiveCmds() {
+		for _, closed := range started {
+			if cmd == closed {
+				t.Fatal("a closed command is still active")
+			}
+		}
+	}
+}
+
+func TestRestartIsRequested(t *testing.T) {
+	cmd, pool, exits := startFake(t, "sleep", true, fastPolicy)
+	waitRunning(t, cmd)
+	first := cmd.GetProcess().Pid
+	cmd.Restart()
+	res := nextExit(t, exits)
+
+	if !res.Requested || res.Stopped() {
+		t.Errorf("Requested = %v, Stopped() = %v, want true and false", res.Requested, res.Stopped())
+	}
+	if res.Signal != syscall.SIGTERM.String() {
+		t.Errorf("Signal = %q, want %q", res.Signal, syscall.SIGTERM.String())
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for cmd.GetProcess().Pid == first {
+		if time.Now().After(deadline) {
+			t.Fatal("the command wasn't restarted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitRunning(t, cmd)
+	cmd.Close()
+	if res := nextExit(t, exits); !res.Stopped() {
+		t.Errorf("exit after Close = %s, want stopped", res)
+	}
+	pool.Close()
+}
+
+func TestRequestedRestartsDontCount(t *testing.T) {
+	policy := fastPolicy
+	policy.InitialDelay = time.Minute
+	policy.MaxRestarts = 1
+	policy.Window = time.Minute
+	cmd, pool, exits := startFake(t, "sleep", true, policy)
+	for i := 0; i < 3; i++ {
+		waitRunning(t, cmd)
+		pid := cmd.GetProcess().Pid
+		if !cmd.Restart() {
+			t.Fatalf("Restart() %d = false with a running process", i+1)
+		}
+		if res := nextExit(t, exits); errors.Is(res.Err, ErrCrashLoop) {
+			t.Fatalf("restart %d reported as a crash loop", i+1)
+		}
+		deadline := time.Now().Add(10 * time.Second)
+		for cmd.GetProcess().Pid == pid {
+			if time.Now().After(deadline) {
+				t.Fatalf("restart %d waited for a backoff", i+1)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	for i, record := range cmd.RestartHistory() {
+		if record.Delay != 0 {
+			t.Errorf("requested restart %d delay = %s, want 0", i+1, record.Delay)
+		}
+	}
+	waitRunning(t, cmd)
+	cmd.Close()
+	nextExit(t, exits)
+	pool.Close()
+
+	if cmd.Restart() {
+		t.Error("Restart() = true without a running process")
+	}
+}
+
+func TestBackoffGrows(t *testing.T) {
+	policy := RestartPolicy{
+		InitialDelay: 10 * time.Millisecond,
+		MaxDelay:     40 * time.Millisecond,
+		Multiplier:   2,
+		MaxRestarts:  4,
+		Window:       time.Minute,
+	}
+	cmd, pool, exits := startFake(t, "exit:1", true, policy)
+	for i := 0; i < 5; i++ {
+		nextExit(t, exits)
+	}
+	pool.Close()
+
+	want := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond, 0}
+	history := cmd.RestartHistory()
+	if len(history) != len(want) {
+		t.Fatalf("got %d restart records, want %d", len(history), len(want))
+	}
+	for i, record := range history {
+		if record.Delay != want[i] {
+			t.Errorf("restart %d delay = %s, want %s", i+1, record.Delay, want[i])
+		}
+		if record.Exit.Code != 1 {
+			t.Errorf("restart %d exit code = %d, want 1", i+1, record.Exit.Code)
+		}
+	}
+}
+
+func TestCrashLoop(t *testing.T) {
+	policy := fastPolicy
+	policy.MaxRestarts = 2
+	policy.Window = time.Minute
+	cmd, pool, exits := startFake(t, "exit:1", true, policy)
+	pool.Close()
+
+	var results []ExitResult
+	for len(exits) > 0 {
+		results = append(results, <-exits)
+	}
+	// two restarts, then the third exit gives up, onExit once per exit
+	if len(results) != 3 {
+		t.Fatalf("onExit called %d times, want 3: %v", len(results), results)
+	}
+	for i, res := range results[:2] {
+		if errors.Is(res.Err, ErrCrashLoop) {
+			t.Errorf("exit %d reported as a crash loop", i+1)
+		}
+	}
+	if last := results[2]; !errors.Is(last.Err, ErrCrashLoop) {
+		t.Errorf("last exit err = %v, want ErrCrashLoop", last.Err)
+	}
+	if cmd.State() != StateFailed {
+		t.Errorf("State = %s, want %s", cmd.State(), StateFailed)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	policy := RestartPolicy{
+		InitialDelay: time.Second,
+		MaxDelay:     5 * time.Second,
+		Multiplier:   2,
+	}.withDefaults()
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, d := range want {
+		if got := policy.delay(i + 1); got != d {
+			t.Errorf("delay(%d) = %s, want %s", i+1, got, d)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := policy.delay(1); got < 500*time.Millisecond || got > 1500*time.Millisecond {
+			t.Fatalf("delay(1) with jitter 0.5 = %s, want within 500ms-1.5s", got)
+		}
+	}
+}
+
+func TestWithDefaultsJitter(t *testing.T) {
+	tests := []struct {
+		jitter float64
+		want   float64
+	}{
+		{jitter: 0, want: 0},
+		{jitter: 0.3, want: 0.3},
+		{jitter: -0.1, want: defaultJitter},
+		{jitter: 1, want: defaultJitter},
+	}
+	for _, tt := range tests {
+		if got := (RestartPolicy{Jitter: tt.jitter}).withDefaults().Jitter; got != tt.want {
+			t.Errorf("Jitter %v defaults to %v, want %v", tt.jitter, got, tt.want)
+		}
+	}
+}
@@ -4,64 +4,84 @@ package externalcmd
 
 import (
 	"errors"
-	"fmt"
-	"os"
+	"io"
 	"os/exec"
 	"syscall"
+	"time"
 
-	"github.com/kballard/go-shellquote"
+	"github.com/meanii/hlsproxy/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
-func (e *Cmd) runOSSpecific(env []string) error {
-	cmdParts, err := shellquote.Split(e.cmdstr)
-	if err != nil {
-		return err
+func (e *Cmd) runOSSpecific(env []string) ExitResult {
+	args := e.Args()
+	if len(args) == 0 {
+		return ExitResult{Code: -1, Err: errors.New("empty command")}
 	}
 
-	cmd := exec.Command(cmdParts[0], cmdParts[1:]...)
+	cmd := exec.Command(args[0], args[1:]...)
 
 	cmd.Env = env
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = e.output.Stdout
+	cmd.Stderr = io.MultiWriter(e.output.Stderr, e.stderrTail)
 
 	// set process group in order to allow killing subprocesses
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
-	err = cmd.Start()
+	_, span := tracing.Tracer().Start(e.ctx, "ffmpeg.spawn",
+		trace.WithAttributes(tracing.StreamID(e.StreamID), attribute.String("process.executable.path", args[0])))
+	err := cmd.Start()
 	if err != nil {
-		return err
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return ExitResult{Code: -1, Err: err}
 	}
+	span.SetAttributes(attribute.Int("process.pid", cmd.Process.Pid))
+	span.End()
+	started := time.Now()
 
 	// adding process to keep in record
+	e.mu.Lock()
 	e.Process = cmd.Process
+	e.mu.Unlock()
 
 	go func() {
-		e.cmdDone <- func() int {
-			err := cmd.Wait()
-			if err == nil {
-				return 0
-			}
-			var ee *exec.ExitError
-			if errors.As(err, &ee) {
-				ee.ExitCode()
-			}
-			return 0
-		}()
+		err := cmd.Wait()
+		e.cmdDone <- newExitResult(err, time.Since(started))
 	}()
 
 	select {
 	case <-e.terminate:
-		zap.S().Infof("killing process id: %s", cmd.Process.Pid)
+		zap.S().Infof("killing process id: %d", cmd.Process.Pid)
 		// the minus is needed to kill all subprocesses
 		syscall.Kill(-cmd.Process.Pid, syscall.SIGINT) //nolint:errcheck
-		<-e.cmdDone
-		return errTerminated
+		res := <-e.cmdDone
+		res.Requested = true
+		res.Err = errTerminated
+		return res
+
+	case res := <-e.cmdDone:
+		res.Requested = e.takeRestartRequest()
+		return res
+	}
+}
 
-	case c := <-e.cmdDone:
-		if c != 0 {
-			return fmt.Errorf("command exited with code %d", c)
-		}
-		return nil
+// Restart terminates the running process, which the command restarts
+// right away, without counting it against the restart policy. It reports
+// false when no process was running.
+func (e *Cmd) Restart() bool {
+	process := e.GetProcess()
+	if process == nil || e.State() != StateRunning {
+		return false
 	}
+	e.mu.Lock()
+	e.restartRequested = true
+	e.mu.Unlock()
+	zap.S().Infof("restarting process id: %d", process.Pid)
+	syscall.Kill(-process.Pid, syscall.SIGTERM) //nolint:errcheck
+	return true
 }
@@ -0,0 +1,71 @@
+package externalcmd
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// ExitResult describes how a single run of a command ended.
+type ExitResult struct {
+	// Code is the exit code of the process, -1 if it was killed by a signal
+	// or never started.
+	Code int `json:"code"`
+	// Signal is the name of the signal that terminated the process, if any.
+	Signal string `json:"signal,omitempty"`
+	// Duration is how long the process ran.
+	Duration time.Duration `json:"duration"`
+	// Requested is true when the exit was caused by Close or Restart.
+	Requested bool `json:"requested"`
+	// Err is set when the process couldn't be started, exited unsuccessfully
+	// or was given up on.
+	Err error `json:"-"`
+}
+
+// Success reports whether the process exited on its own with code 0.
+func (r ExitResult) Success() bool {
+	return r.Err == nil && r.Code == 0 && r.Signal == ""
+}
+
+func (r ExitResult) String() string {
+	switch {
+	case r.Stopped():
+		return "stopped on request"
+	case r.Requested:
+		return "restarted on request"
+	case r.Signal != "":
+		return fmt.Sprintf("killed by signal %s after %s", r.Signal, r.Duration.Round(time.Millisecond))
+	case r.Err != nil && r.Code < 0:
+		return r.Err.Error()
+	}
+	return fmt.Sprintf("exited with code %d after %s", r.Code, r.Duration.Round(time.Millisecond))
+}
+
+// Stopped reports whether the process was stopped for good by Close.
+func (r ExitResult) Stopped() bool {
+	return errors.Is(r.Err, errTerminated)
+}
+
+// newExitResult builds an ExitResult out of the error returned by exec.Cmd.Wait.
+func newExitResult(waitErr error, duration time.Duration) ExitResult {
+	res := ExitResult{Duration: duration}
+	if waitErr == nil {
+		return res
+	}
+
+	var ee *exec.ExitError
+	if !errors.As(waitErr, &ee) {
+		res.Code = -1
+		res.Err = waitErr
+		return res
+	}
+
+	res.Code = ee.ExitCode()
+	if ws, ok := ee.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		res.Signal = ws.Signal().String()
+	}
+	res.Err = fmt.Errorf("command %s", res)
+	return res
+}
@@ -0,0 +1,91 @@
+package externalcmd
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultInitialDelay = 1 * time.Second
+	defaultMaxDelay     = 1 * time.Minute
+	defaultMultiplier   = 2
+	defaultJitter       = 0.2
+	defaultMaxRestarts  = 5
+	defaultWindow       = 5 * time.Minute
+
+	// maxRestartHistory is the number of restart records kept per command.
+	maxRestartHistory = 20
+)
+
+// RestartPolicy controls how a failed command is restarted.
+// Zero values are replaced with defaults, except for Jitter where 0
+// disables it; a negative MaxRestarts disables crash-loop detection.
+type RestartPolicy struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	Jitter       float64
+	MaxRestarts  int
+	Window       time.Duration
+}
+
+// RestartRecord describes a single exit of a restarting command.
+type RestartRecord struct {
+	Time   time.Time     `json:"time"`
+	Exit   ExitResult    `json:"exit"`
+	Error  string        `json:"error,omitempty"`
+	Stderr []string      `json:"stderr,omitempty"`
+	Delay  time.Duration `json:"delay"`
+}
+
+func (p RestartPolicy) withDefaults() RestartPolicy {
+	if p.InitialDelay <= 0 {
+		p.InitialDelay = defaultInitialDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = defaultMaxDelay
+	}
+	if p.MaxDelay < p.InitialDelay {
+		p.MaxDelay = p.InitialDelay
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = defaultMultiplier
+	}
+	if p.Jitter < 0 || p.Jitter >= 1 {
+		p.Jitter = defaultJitter
+	}
+	if p.MaxRestarts == 0 {
+		p.MaxRestarts = defaultMaxRestarts
+	}
+	if p.Window <= 0 {
+		p.Window = defaultWindow
+	}
+	return p
+}
+
+// delay returns the pause before the given restart attempt (starting at 1),
+// growing exponentially up to MaxDelay and randomised by Jitter.
+func (p RestartPolicy) delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	d := float64(p.InitialDelay) * math.Pow(p.Multiplier, float64(attempt-1))
+	if d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	d += d * p.Jitter * (2*rand.Float64() - 1)
+	return time.Duration(d)
+}
+
+// restartsWithin counts the records of unrequested exits newer than now
+// minus window.
+func restartsWithin(history []RestartRecord, now time.Time, window time.Duration) int {
+	n := 0
+	for _, r := range history {
+		if !r.Exit.Requested && now.Sub(r.Time) <= window {
+			n++
+		}
+	}
+	return n
+}
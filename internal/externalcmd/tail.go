@@ -0,0 +1,56 @@
+package externalcmd
+
+import (
+	"bytes"
+	"sync"
+)
+
+// tailWriter keeps the last lines written to it.
+type tailWriter struct {
+	mu      sync.Mutex
+	max     int
+	lines   []string
+	partial []byte
+}
+
+func newTailWriter(max int) *tailWriter {
+	return &tailWriter{max: max}
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	buf := append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		t.push(string(bytes.TrimRight(buf[:i], "\r")))
+		buf = buf[i+1:]
+	}
+	t.partial = append([]byte(nil), buf...)
+	return len(p), nil
+}
+
+func (t *tailWriter) push(line string) {
+	t.lines = append(t.lines, line)
+	if len(t.lines) > t.max {
+		t.lines = t.lines[len(t.lines)-t.max:]
+	}
+}
+
+// Flush returns the buffered lines and clears them.
+func (t *tailWriter) Flush() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.partial) > 0 {
+		t.push(string(t.partial))
+		t.partial = nil
+	}
+	lines := t.lines
+	t.lines = nil
+	return lines
+}
@@ -0,0 +1,71 @@
+// Package ffmpeg builds ffmpeg command lines as argument lists, so that
+// no part of them is ever re-parsed by a shell.
+package ffmpeg
+
+import "strings"
+
+// Input is an ffmpeg input with the options placed before its -i.
+type Input struct {
+	URL     string
+	Options []string
+}
+
+// Output is an ffmpeg output with the options placed before its URL.
+type Output struct {
+	URL     string
+	Options []string
+}
+
+// Args builds the argument list of an ffmpeg invocation.
+type Args struct {
+	global  []string
+	inputs  []Input
+	filters []string
+	outputs []Output
+}
+
+// NewArgs allocates an empty Args.
+func NewArgs() *Args {
+	return &Args{}
+}
+
+// Global appends options that apply to the whole invocation, e.g. -loglevel.
+func (a *Args) Global(options ...string) *Args {
+	a.global = append(a.global, options...)
+	return a
+}
+
+// Input appends an input and returns its index.
+func (a *Args) Input(url string, options ...string) int {
+	a.inputs = append(a.inputs, Input{URL: url, Options: options})
+	return len(a.inputs) - 1
+}
+
+// Filter appends a chain to the -filter_complex graph.
+func (a *Args) Filter(chain string) *Args {
+	a.filters = append(a.filters, chain)
+	return a
+}
+
+// Output appends an output.
+func (a *Args) Output(url string, options ...string) *Args {
+	a.outputs = append(a.outputs, Output{URL: url, Options: options})
+	return a
+}
+
+// Build returns the arguments, without the ffmpeg binary itself.
+func (a *Args) Build() []string {
+	args := append([]string(nil), a.global...)
+	for _, in := range a.inputs {
+		args = append(args, in.Options...)
+		args = append(args, "-i", in.URL)
+	}
+	if len(a.filters) > 0 {
+		args = append(args, "-filter_complex", strings.Join(a.filters, ";"))
+	}
+	for _, out := range a.outputs {
+		args = append(args, out.Options...)
+		args = append(args, out.URL)
+	}
+	return args
+}
@@ -0,0 +1,377 @@
+// Package janitor bounds the disk usage of the output directory: it
+// enforces retention by age and size, per stream and globally, and evicts
+// directories of streams that are no longer registered. Segments listed by
+// the current media playlists are never deleted, players may still fetch
+// them.
+package janitor
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meanii/hlsproxy/config"
+	"github.com/meanii/hlsproxy/internal/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultInterval = 30 * time.Second
+	// orphanGrace leaves time to a new stream to register after its
+	// output directory was created.
+	orphanGrace = 1 * time.Minute
+)
+
+// Options configures a Janitor. Zero values disable the matching limit.
+type Options struct {
+	Interval time.Duration
+	// MaxAge deletes segments older than this.
+	MaxAge time.Duration
+	// StreamQuota is the default size limit of a stream directory, in bytes.
+	StreamQuota int64
+	// GlobalQuota is the size limit of the whole output directory, in bytes.
+	GlobalQuota int64
+}
+
+// Usage is the disk usage of a stream directory.
+type Usage struct {
+	Bytes    int64 `json:"bytes"`
+	Segments int   `json:"segments"`
+	Quota    int64 `json:"quota,omitempty"`
+}
+
+// Janitor periodically scans the output directory.
+type Janitor struct {
+	root   string
+	opts   Options
+	active func(id string) bool
+
+	mu     sync.RWMutex
+	quotas map[string]int64
+	usage  map[string]Usage
+	total  int64
+}
+
+type segmentFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+	// listed is set when a playlist of the stream references the segment,
+	// or will once ffmpeg is done writing it
+	listed bool
+}
+
+// New allocates a Janitor for root. active reports whether a stream ID is
+// still registered, directories of other streams are evicted.
+func New(root string, opts Options, active func(id string) bool) *Janitor {
+	if opts.Interval <= 0 {
+		opts.Interval = defaultInterval
+	}
+	return &Janitor{
+		root:   root,
+		opts:   opts,
+		active: active,
+		quotas: make(map[string]int64),
+		usage:  make(map[string]Usage),
+	}
+}
+
+// SetStreamQuota overrides the size limit of a stream, 0 restores the default.
+func (j *Janitor) SetStreamQuota(id string, bytes int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if bytes <= 0 {
+		delete(j.quotas, id)
+		return
+	}
+	j.quotas[id] = bytes
+}
+
+func (j *Janitor) quota(id string) int64 {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	if q, ok := j.quotas[id]; ok {
+		return q
+	}
+	return j.opts.StreamQuota
+}
+
+// Usage returns the usage of every stream as of the last scan and their total.
+func (j *Janitor) Usage() (map[string]Usage, int64) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	usage := make(map[string]Usage, len(j.usage))
+	for id, u := range j.usage {
+		usage[id] = u
+	}
+	return usage, j.total
+}
+
+// StreamUsage returns the usage of a single stream as of the last scan.
+func (j *Janitor) StreamUsage(id string) (Usage, bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	u, ok := j.usage[id]
+	return u, ok
+}
+
+// Run scans the output directory until ctx is done.
+func (j *Janitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		j.Sweep()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep runs a single pass of every retention rule.
+func (j *Janitor) Sweep() {
+	entries, err := os.ReadDir(j.root)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			zap.S().Warnf("janitor: failed to read %s, Error: %s", j.root, err)
+		}
+		return
+	}
+
+	now := time.Now()
+	streams := make(map[string][]segmentFile)
+	usage := make(map[string]Usage)
+	var total int64
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		id := entry.Name()
+		dir := filepath.Join(j.root, id)
+		segments, size, newest := scan(dir)
+
+		if !j.active(id) && now.Sub(newest) > orphanGrace {
+			zap.S().Infof("janitor: evicting orphaned stream directory %s (%d bytes)", dir, size)
+			if err := os.RemoveAll(dir); err != nil {
+				zap.S().Warnf("janitor: failed to remove %s, Error: %s", dir, err)
+			}
+			j.SetStreamQuota(id, 0)
+			continue
+		}
+
+		segments, size = j.enforceAge(segments, size, now)
+		segments, size = enforceQuota(segments, size, j.quota(id))
+		if quota := j.quota(id); quota > 0 && size > quota {
+			zap.S().Warnf("janitor: stream %s uses %d bytes over its %d bytes quota, its live window doesn't fit", id, size, quota)
+		}
+		streams[id] = segments
+		usage[id] = Usage{Bytes: size, Segments: len(segments), Quota: j.quota(id)}
+		total += size
+	}
+
+	total = j.enforceGlobalQuota(streams, usage, total)
+
+	j.mu.Lock()
+	j.usage = usage
+	j.total = total
+	j.mu.Unlock()
+
+	metrics.DiskUsage.Set(float64(total))
+	metrics.StreamDiskUsage.Reset()
+	for id, u := range usage {
+		metrics.StreamDiskUsage.WithLabelValues(id).Set(float64(u.Bytes))
+	}
+}
+
+// scan returns the media segments of a stream directory, oldest first,
+// the size of every file in it and the modification time of the newest one.
+func scan(dir string) ([]segmentFile, int64, time.Time) {
+	var segments []segmentFile
+	var size int64
+	var newest time.Time
+	listed := make(map[string]bool)
+	// playlists holds the modification time of the playlists by directory
+	playlists := make(map[string]time.Time)
+
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		if d.IsDir() {
+			return nil
+		}
+		size += info.Size()
+		switch {
+		case isSegment(p):
+			segments = append(segments, segmentFile{path: p, size: info.Size(), modTime: info.ModTime()})
+		case filepath.Ext(p) == ".m3u8":
+			for _, segment := range playlistSegments(p) {
+				listed[segment] = true
+			}
+			if dir := filepath.Dir(p); info.ModTime().After(playlists[dir]) {
+				playlists[dir] = info.ModTime()
+			}
+		}
+		return nil
+	})
+
+	for i, segment := range segments {
+		// segments newer than their playlist are still being written
+		updated, ok := playlists[filepath.Dir(segment.path)]
+		segments[i].listed = listed[segment.path] || ok && !segment.modTime.Before(updated)
+	}
+	sortOldestFirst(segments)
+	return segments, size, newest
+}
+
+// playlistSegments returns the paths of the local files a playlist lists.
+func playlistSegments(playlist string) []string {
+	data, err := os.ReadFile(playlist)
+	if err != nil {
+		return nil
+	}
+	var paths []string
+	for _, line := range strings.Split(string(data), "\n") {
+		uri := strings.TrimSpace(line)
+		if uri == "" || strings.HasPrefix(uri, "#") || strings.Contains(uri, "://") || filepath.IsAbs(uri) {
+			continue
+		}
+		paths = append(paths, filepath.Join(filepath.Dir(playlist), filepath.FromSlash(uri)))
+	}
+	return paths
+}
+
+// isSegment reports whether p is a media segment, the only files the
+// janitor deletes from a live stream. Playlists and init segments stay.
+func isSegment(p string) bool {
+	switch filepath.Ext(p) {
+	case ".ts", ".m4s", ".vtt":
+		return true
+	}
+	return false
+}
+
+func sortOldestFirst(segments []segmentFile) {
+	sort.Slice(segments, func(a, b int) bool {
+		return segments[a].modTime.Before(segments[b].modTime)
+	})
+}
+
+func (j *Janitor) enforceAge(segments []segmentFile, size int64, now time.Time) ([]segmentFile, int64) {
+	if j.opts.MaxAge <= 0 {
+		return segments, size
+	}
+	kept := segments[:0]
+	for _, segment := range segments {
+		if !segment.listed && now.Sub(segment.modTime) > j.opts.MaxAge && remove(segment) {
+			size -= segment.size
+			continue
+		}
+		kept = append(kept, segment)
+	}
+	return kept, size
+}
+
+// enforceQuota deletes the oldest segments until size fits in quota, or
+// only listed segments are left.
+func enforceQuota(segments []segmentFile, size int64, quota int64) ([]segmentFile, int64) {
+	if quota <= 0 {
+		return segments, size
+	}
+	kept := segments[:0]
+	for _, segment := range segments {
+		if size > quota && !segment.listed && remove(segment) {
+			size -= segment.size
+			continue
+		}
+		kept = append(kept, segment)
+	}
+	return kept, size
+}
+
+// enforceGlobalQuota deletes the oldest segments across every stream until
+// the output directory fits in the global quota, and returns the new total.
+func (j *Janitor) enforceGlobalQuota(streams map[string][]segmentFile, usage map[string]Usage, total int64) int64 {
+	if j.opts.GlobalQuota <= 0 || total <= j.opts.GlobalQuota {
+		return total
+	}
+
+	type owned struct {
+		id string
+		segmentFile
+	}
+	var all []owned
+	for id, segments := range streams {
+		for _, segment := range segments {
+			all = append(all, owned{id: id, segmentFile: segment})
+		}
+	}
+	sort.Slice(all, func(a, b int) bool {
+		return all[a].modTime.Before(all[b].modTime)
+	})
+
+	zap.S().Warnf("janitor: output directory uses %d bytes over its %d bytes quota", total, j.opts.GlobalQuota)
+	for _, segment := range all {
+		if total <= j.opts.GlobalQuota {
+			break
+		}
+		if segment.listed || !remove(segment.segmentFile) {
+			continue
+		}
+		total -= segment.size
+		u := usage[segment.id]
+		u.Bytes -= segment.size
+		u.Segments--
+		usage[segment.id] = u
+	}
+	if total > j.opts.GlobalQuota {
+		zap.S().Warnf("janitor: the live windows of the streams don't fit in the %d bytes quota", j.opts.GlobalQuota)
+	}
+	return total
+}
+
+func remove(segment segmentFile) bool {
+	err := os.Remove(segment.path)
+	if err != nil && !os.IsNotExist(err) {
+		zap.S().Warnf("janitor: failed to remove %s, Error: %s", segment.path, err)
+		return false
+	}
+	return true
+}
+
+var instance *Janitor
+
+// Start runs the janitor of the configured output directory in the
+// background. active reports whether a stream ID is still registered.
+func Start(ctx context.Context, active func(id string) bool) *Janitor {
+	cfg := config.GetConfig("").Config.Output
+	instance = New(cfg.Dirname, Options{
+		Interval:    cfg.Retention.Interval,
+		MaxAge:      cfg.Retention.MaxAge,
+		StreamQuota: cfg.Retention.StreamQuota,
+		GlobalQuota: cfg.Retention.GlobalQuota,
+	}, active)
+	zap.S().Infof("janitor: watching %s every %s", cfg.Dirname, instance.opts.Interval)
+	go instance.Run(ctx)
+	return instance
+}
+
+// GetJanitor returns the janitor started by Start, nil before it.
+func GetJanitor() *Janitor {
+	return instance
+}
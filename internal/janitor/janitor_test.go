@@ -0,0 +1,135 @@
+package janitor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeStream creates a rendition of stream id with segments 001.ts to
+// 00n.ts, one minute apart and 100 bytes each, and a playlist listing the
+// given ones.
+func writeStream(t *testing.T, root, id string, n int, listed ...string) string {
+	t.Helper()
+	dir := filepath.Join(root, id, "720p")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(-time.Hour)
+	for i := 1; i <= n; i++ {
+		p := filepath.Join(dir, segmentName(i))
+		if err := os.WriteFile(p, make([]byte, 100), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := start.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(p, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:2\n"
+	for _, segment := range listed {
+		playlist += "#EXTINF:2.000000,\n" + segment + "\n"
+	}
+	p := filepath.Join(dir, "720p.m3u8")
+	if err := os.WriteFile(p, []byte(playlist), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// the playlist was last written along with the newest segment
+	modTime := start.Add(time.Duration(n) * time.Minute)
+	if err := os.Chtimes(p, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func segmentName(i int) string {
+	return fmt.Sprintf("%03d.ts", i)
+}
+
+func remaining(t *testing.T, dir string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(dir, "*.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, m := range matches {
+		names = append(names, filepath.Base(m))
+	}
+	return names
+}
+
+func active(string) bool { return true }
+
+func TestSweepKeepsListedSegments(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{
+			name: "age",
+			opts: Options{MaxAge: time.Minute},
+			want: []string{"003.ts", "004.ts", "005.ts"},
+		},
+		{
+			name: "stream quota",
+			opts: Options{StreamQuota: 350},
+			want: []string{"003.ts", "004.ts", "005.ts"},
+		},
+		{
+			name: "stream quota over the live window",
+			opts: Options{StreamQuota: 100},
+			want: []string{"003.ts", "004.ts", "005.ts"},
+		},
+		{
+			name: "global quota",
+			opts: Options{GlobalQuota: 100},
+			want: []string{"003.ts", "004.ts", "005.ts"},
+		},
+		{
+			name: "within quota",
+			opts: Options{StreamQuota: 1000},
+			want: []string{"001.ts", "002.ts", "003.ts", "004.ts", "005.ts"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			// 005.ts is newer than the playlist: ffmpeg is still writing it
+			dir := writeStream(t, root, "stream", 5, "003.ts", "004.ts")
+			p := filepath.Join(dir, "005.ts")
+			now := time.Now()
+			if err := os.Chtimes(p, now, now); err != nil {
+				t.Fatal(err)
+			}
+
+			New(root, tt.opts, active).Sweep()
+
+			got := remaining(t, dir)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("remaining segments = %v, want %v", got, tt.want)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "720p.m3u8")); err != nil {
+				t.Errorf("playlist was deleted: %v", err)
+			}
+		})
+	}
+}
+
+func TestPlaylistSegments(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "720p.m3u8")
+	playlist := "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:2.000000,\n001.m4s\n\n#EXTINF:2.000000,\nhttps://cdn.example.com/002.m4s\n#EXTINF:2.000000,\n003.m4s\r\n"
+	if err := os.WriteFile(p, []byte(playlist), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got := playlistSegments(p)
+	want := []string{filepath.Join(dir, "001.m4s"), filepath.Join(dir, "003.m4s")}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("playlistSegments() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,178 @@
+// Package metrics holds the Prometheus metrics of the proxy.
+package metrics
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "hlsproxy"
+
+var (
+	// FfmpegRestarts counts the unrequested ffmpeg exits followed by a restart.
+	FfmpegRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ffmpeg_restarts_total",
+		Help:      "Unrequested ffmpeg exits, per stream.",
+	}, []string{"stream"})
+
+	// SpawnFailures counts the ffmpeg processes that couldn't be started.
+	SpawnFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ffmpeg_spawn_failures_total",
+		Help:      "ffmpeg processes that couldn't be started.",
+	})
+
+	// StartFailures counts the streams that never got ready, by reason.
+	StartFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stream_start_failures_total",
+		Help:      "Streams stopped before they got ready, by reason.",
+	}, []string{"reason"})
+
+	// WatchdogActions counts the actions taken on unhealthy streams.
+	WatchdogActions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "watchdog_actions_total",
+		Help:      "Stalled, black, frozen or silent streams, by condition and action.",
+	}, []string{"condition", "action"})
+
+	// SourceSwitches counts the failovers between the sources of streams.
+	SourceSwitches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "source_switches_total",
+		Help:      "Switches of streams to another of their sources, by reason.",
+	}, []string{"reason"})
+
+	// TimeToFirstSegment observes how long streams take to be ready.
+	TimeToFirstSegment = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "time_to_first_segment_seconds",
+		Help:      "Time from starting ffmpeg to every rendition having its first segments.",
+		Buckets:   []float64{0.5, 1, 2, 3, 5, 8, 13, 21, 34, 55},
+	})
+
+	// Segments counts the segments produced per stream and rendition.
+	Segments = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "segments_total",
+		Help:      "Media segments produced, per stream and rendition.",
+	}, []string{"stream", "rendition"})
+
+	// SegmentBytes counts the bytes of the segments produced.
+	SegmentBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "segment_bytes_total",
+		Help:      "Bytes of media segments produced, per stream and rendition.",
+	}, []string{"stream", "rendition"})
+
+	// DiskUsage is the size of the output directory as of the last janitor sweep.
+	DiskUsage = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "output_disk_bytes",
+		Help:      "Size of the output directory.",
+	})
+
+	// StreamDiskUsage is the size of every stream directory.
+	StreamDiskUsage = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stream_disk_bytes",
+		Help:      "Size of the output directory of a stream.",
+	}, []string{"stream"})
+
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests, by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+
+	httpResponseSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_response_size_bytes",
+		Help:      "Size of HTTP responses by route, its sum is the bytes served.",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 10),
+	}, []string{"route", "method", "code"})
+)
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// InstrumentHandler counts the requests of a route, their latency and the
+// bytes served.
+func InstrumentHandler(route string, handler http.Handler) http.Handler {
+	labels := prometheus.Labels{"route": route}
+	handler = promhttp.InstrumentHandlerResponseSize(httpResponseSize.MustCurryWith(labels), handler)
+	handler = promhttp.InstrumentHandlerDuration(httpDuration.MustCurryWith(labels), handler)
+	return promhttp.InstrumentHandlerCounter(httpRequests.MustCurryWith(labels), handler)
+}
+
+// streamsCollector reports the registered streams by lifecycle state,
+// read from states at scrape time.
+type streamsCollector struct {
+	mu     sync.RWMutex
+	states func() map[string]int
+
+	active  *prometheus.Desc
+	byState *prometheus.Desc
+}
+
+var streams = &streamsCollector{
+	active: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "active_streams"),
+		"Registered streams.", nil, nil),
+	byState: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "streams"),
+		"Registered streams, by lifecycle state.", []string{"state"}, nil),
+}
+
+func init() {
+	prometheus.MustRegister(streams)
+}
+
+// SetStreamStates sets the function counting the registered streams by state.
+func SetStreamStates(states func() map[string]int) {
+	streams.mu.Lock()
+	defer streams.mu.Unlock()
+	streams.states = states
+}
+
+func (c *streamsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.active
+	ch <- c.byState
+}
+
+func (c *streamsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	states := c.states
+	c.mu.RUnlock()
+	if states == nil {
+		return
+	}
+
+	total := 0
+	for state, n := range states() {
+		total += n
+		ch <- prometheus.MustNewConstMetric(c.byState, prometheus.GaugeValue, float64(n), state)
+	}
+	ch <- prometheus.MustNewConstMetric(c.active, prometheus.GaugeValue, float64(total))
+}
+
+// ForgetStream drops the per-stream series of a stream that was removed.
+func ForgetStream(id string) {
+	labels := prometheus.Labels{"stream": id}
+	FfmpegRestarts.DeletePartialMatch(labels)
+	Segments.DeletePartialMatch(labels)
+	SegmentBytes.DeletePartialMatch(labels)
+	StreamDiskUsage.DeletePartialMatch(labels)
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/meanii/hlsproxy/internal/events"
+)
+
+const (
+	sseHeartbeat  = 15 * time.Second
+	sseRetry      = 3 * time.Second
+	sseBufferSize = 256
+)
+
+// AddEventsRouter streams the event bus as Server-Sent Events. Clients
+// resume after the Last-Event-ID header or the cursor parameter, a "gap"
+// event tells them older events were already dropped
+// GET /events?stream=<id>&type=<event type>&cursor=<seq>
+func (s *Server) AddEventsRouter() {
+	handleFunc("GET /events", func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			w.WriteHeader(500)
+			w.Write([]byte("streaming isn't supported"))
+			return
+		}
+
+		query := r.URL.Query()
+		streams := toSet(query["stream"])
+		types := toSet(query["type"])
+
+		cursorParam := r.Header.Get("Last-Event-ID")
+		if cursorParam == "" {
+			cursorParam = query.Get("cursor")
+		}
+
+		var past []events.Event
+		var next <-chan events.Event
+		var stop func()
+		var last uint64
+		missed := false
+		if cursorParam != "" {
+			cursor, err := strconv.ParseUint(cursorParam, 10, 64)
+			if err != nil {
+				w.WriteHeader(400)
+				w.Write([]byte("cursor must be an event seq"))
+				return
+			}
+			last = cursor
+			past, next, stop, missed = events.SubscribeFrom(cursor, sseBufferSize)
+		} else {
+			next, stop = events.Subscribe(sseBufferSize)
+		}
+		defer stop()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+		if missed {
+			fmt.Fprintf(w, "event: gap\ndata: {\"cursor\":%s}\n\n", cursorParam)
+		}
+
+		send := func(e events.Event) {
+			last = e.Seq
+			if (len(streams) > 0 && !streams[e.StreamID]) || (len(types) > 0 && !types[string(e.Type)]) {
+				return
+			}
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, data)
+		}
+		for _, e := range past {
+			send(e)
+		}
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(sseHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": ping\n\n")
+			case e, ok := <-next:
+				if !ok {
+					return
+				}
+				if e.Seq <= last {
+					continue
+				}
+				if last != 0 && e.Seq > last+1 {
+					// the subscription fell behind and lost events
+					fmt.Fprintf(w, "event: gap\ndata: {\"cursor\":%d}\n\n", last)
+				}
+				send(e)
+			}
+			flusher.Flush()
+		}
+	})
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meanii/hlsproxy/internal/events"
+)
+
+var eventsRouter sync.Once
+
+// sseEvent is a block of the event stream.
+type sseEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+// subscribe opens GET /events with the given query and reads the retry
+// block, the subscription is active once it returns.
+func subscribe(t *testing.T, query string, lastEventID string) *bufio.Reader {
+	t.Helper()
+	eventsRouter.Do(func() { (&Server{}).AddEventsRouter() })
+	server := httptest.NewServer(http.DefaultServeMux)
+	t.Cleanup(server.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/events?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET /events?%s responded %d", query, res.StatusCode)
+	}
+
+	r := bufio.NewReader(res.Body)
+	if block := readBlock(t, r); !strings.HasPrefix(block[0], "retry: ") {
+		t.Fatalf("first block = %v, want the retry delay", block)
+	}
+	return r
+}
+
+// readBlock reads the lines of the next block, skipping heartbeats.
+func readBlock(t *testing.T, r *bufio.Reader) []string {
+	t.Helper()
+	var block []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading the event stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && len(block) > 0:
+			return block
+		case line == "" || strings.HasPrefix(line, ":"):
+		default:
+			block = append(block, line)
+		}
+	}
+}
+
+// readEvent reads the next event of the stream.
+func readEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+	var e sseEvent
+	for _, line := range readBlock(t, r) {
+		field, value, _ := strings.Cut(line, ": ")
+		switch field {
+		case "id":
+			e.id = value
+		case "event":
+			e.event = value
+		case "data":
+			e.data = value
+		}
+	}
+	return e
+}
+
+func TestEventsResume(t *testing.T) {
+	for i := 0; i < 3; i++ {
+		events.Publish(events.Event{Type: events.SegmentCreated, StreamID: "resume"})
+	}
+	last := events.Latest()
+
+	r := subscribe(t, fmt.Sprintf("cursor=%d", last-1), "")
+	if e := readEvent(t, r); e.id != fmt.Sprint(last) {
+		t.Errorf("first event #%s, want #%d right after the cursor", e.id, last)
+	}
+	events.Publish(events.Event{Type: events.StreamLive, StreamID: "resume"})
+	if e := readEvent(t, r); e.id != fmt.Sprint(last+1) || e.event != string(events.StreamLive) {
+		t.Errorf("live event %s #%s, want %s #%d", e.event, e.id, events.StreamLive, last+1)
+	}
+}
+
+func TestEventsGap(t *testing.T) {
+	events.Publish(events.Event{Type: events.SegmentCreated, StreamID: "gap"})
+	cursor := events.Latest()
+	// the history keeps 1000 events
+	for i := 0; i < 1001; i++ {
+		events.Publish(events.Event{Type: events.SegmentCreated, StreamID: "gap"})
+	}
+
+	r := subscribe(t, "", fmt.Sprint(cursor-1))
+	gap := readEvent(t, r)
+	if gap.event != "gap" || gap.data != fmt.Sprintf(`{"cursor":%d}`, cursor-1) {
+		t.Errorf("first event %s %s, want a gap at the cursor", gap.event, gap.data)
+	}
+	if e := readEvent(t, r); e.id != fmt.Sprint(cursor+2) {
+		t.Errorf("event after the gap #%s, want the oldest kept #%d", e.id, cursor+2)
+	}
+}
+
+func TestEventsDedup(t *testing.T) {
+	// a cursor ahead of the bus, e.g. from before hlsproxy restarted,
+	// skips the events up to it
+	cursor := events.Latest() + 1
+	r := subscribe(t, "stream=dedup", fmt.Sprint(cursor))
+	events.Publish(events.Event{Type: events.SegmentCreated, StreamID: "dedup"})
+	events.Publish(events.Event{Type: events.SegmentDeleted, StreamID: "dedup"})
+	if e := readEvent(t, r); e.id != fmt.Sprint(cursor+1) || e.event != string(events.SegmentDeleted) {
+		t.Errorf("first event %s #%s, want %s #%d after the cursor", e.event, e.id, events.SegmentDeleted, cursor+1)
+	}
+}
+
+func TestEventsFilters(t *testing.T) {
+	r := subscribe(t, "stream=wanted&type=stream.live&type=stream.failed", "")
+	published := []events.Event{
+		{Type: events.StreamLive, StreamID: "other"},
+		{Type: events.SegmentCreated, StreamID: "wanted"},
+		{Type: events.StreamLive, StreamID: "wanted"},
+		{Type: events.CapacityChanged},
+		{Type: events.StreamFailed, StreamID: "wanted"},
+	}
+	for _, e := range published {
+		events.Publish(e)
+	}
+	for _, want := range []events.Type{events.StreamLive, events.StreamFailed} {
+		if e := readEvent(t, r); e.event != string(want) || !strings.Contains(e.data, `"stream_id":"wanted"`) {
+			t.Errorf("received %s %s, want %s of stream wanted", e.event, e.data, want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"github.com/meanii/hlsproxy/config"
+	"github.com/meanii/hlsproxy/internal/janitor"
+	"github.com/meanii/hlsproxy/internal/storage"
+	"github.com/meanii/hlsproxy/internal/transcoder"
+)
+
+const checkTimeout = 2 * time.Second
+
+var startedAt = time.Now()
+
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) (string, error)
+}
+
+type checkResultHTTP struct {
+	Status   string        `json:"status"`
+	Detail   string        `json:"detail,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+type readinessHTTP struct {
+	Status string                     `json:"status"`
+	Checks map[string]checkResultHTTP `json:"checks"`
+}
+
+// AddHealthRouter exposes the liveness and readiness probes, neither of
+// them ever creates a stream
+// GET /healthz
+// GET /readyz
+func (s *Server) AddHealthRouter() {
+	handleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"status": "ok",
+			"uptime": time.Since(startedAt).Round(time.Second).String(),
+		})
+	})
+
+	handleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		result := readinessHTTP{Status: "ok", Checks: make(map[string]checkResultHTTP)}
+		for _, c := range readinessChecks() {
+			ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+			start := time.Now()
+			detail, err := c.check(ctx)
+			cancel()
+
+			check := checkResultHTTP{Status: "ok", Detail: detail, Duration: time.Since(start)}
+			if err != nil {
+				check.Status = "fail"
+				check.Error = err.Error()
+				result.Status = "fail"
+			}
+			result.Checks[c.name] = check
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if result.Status != "ok" {
+			w.WriteHeader(503)
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+// readinessChecks lists the dependencies a stream start needs. There is no
+// database check, the proxy keeps its state in memory and
+// internal/database holds no connection to probe.
+func readinessChecks() []healthCheck {
+	return []healthCheck{
+		{"config", checkConfig},
+		{"ffmpeg", checkFfmpeg},
+		{"output_dir", checkOutputDir},
+		{"storage", checkStorage},
+		{"capacity", checkCapacity},
+	}
+}
+
+func checkConfig(_ context.Context) (string, error) {
+	if config.GlobalConfigInstance == nil {
+		return "", errors.New("config isn't loaded")
+	}
+	return "", nil
+}
+
+// checkFfmpeg verifies the configured binary exists and is executable.
+func checkFfmpeg(_ context.Context) (string, error) {
+	bin := config.GetConfig("").Config.Ffmpeg.Bin
+	if bin == "" {
+		return "", errors.New("ffmpeg bin isn't configured")
+	}
+	p, err := exec.LookPath(bin)
+	if err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+func checkOutputDir(ctx context.Context) (string, error) {
+	output := config.GetConfig("").Config.Output.Dirname
+	local := storage.NewLocal(output, "")
+	return local.Root(), local.Check(ctx)
+}
+
+// checkStorage verifies a remote storage is reachable, the local one is
+// the output directory.
+func checkStorage(ctx context.Context) (string, error) {
+	store := storage.GetStorage()
+	if storage.IsLocal(store) {
+		return "local", nil
+	}
+	if storage.IsMemory(store) {
+		return "memory", nil
+	}
+	checker, ok := store.(storage.Checker)
+	if !ok {
+		return "", nil
+	}
+	return config.GetConfig("").Config.Output.Storage.Type, checker.Check(ctx)
+}
+
+// checkCapacity verifies the node can take another stream and the output
+// directory is within its quota.
+func checkCapacity(_ context.Context) (string, error) {
+	cfg := config.GetConfig("").Config
+	detail := fmt.Sprintf("%d streams", transcoder.Count())
+	if cfg.Ffmpeg.MaxStreams > 0 {
+		detail = fmt.Sprintf("%d/%d streams", transcoder.Count(), cfg.Ffmpeg.MaxStreams)
+	}
+	if !transcoder.HasCapacity() {
+		return detail, errors.New("max_streams reached")
+	}
+
+	quota := cfg.Output.Retention.GlobalQuota
+	if j := janitor.GetJanitor(); j != nil && quota > 0 {
+		if _, total := j.Usage(); total >= quota {
+			return detail, fmt.Errorf("output dir uses %d bytes of its %d bytes quota", total, quota)
+		}
+	}
+	return detail, nil
+}
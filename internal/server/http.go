@@ -1,16 +1,22 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
-	"syscall"
+	"strconv"
 
 	"github.com/google/uuid"
 	"github.com/meanii/hlsproxy/config"
 	"github.com/meanii/hlsproxy/internal/externalcmd"
+	"github.com/meanii/hlsproxy/internal/janitor"
+	"github.com/meanii/hlsproxy/internal/storage"
 	"github.com/meanii/hlsproxy/internal/transcoder"
 	"go.uber.org/zap"
 )
@@ -22,11 +28,23 @@ type Server struct {
 type rtmpConfigHTTP struct {
 	ID      string `json:"id" validate:"required"`
 	RtmpURL string `json:"rtmp_url" validate:"required"`
-	Config  struct {
-		Varients   []string `json:"varients"`
-		VideoCodec string   `json:"video_codec"`
-		AudioCodec string   `json:"audio_codec"`
-		Audio      bool     `json:"audio" validate:"required"`
+	// BackupURLs are the sources switched to, in order, when the stream fails.
+	BackupURLs []string `json:"backup_urls"`
+	// Slate overrides the configured slate shown while no source is up.
+	Slate  string `json:"slate"`
+	Config struct {
+		Varients     []string                    `json:"varients"`
+		VideoCodec   string                      `json:"video_codec"`
+		Encoder      string                      `json:"encoder"`
+		AudioCodec   string                      `json:"audio_codec"`
+		Audio        bool                        `json:"audio" validate:"required"`
+		AudioTracks  []transcoder.AudioTrack     `json:"audio_tracks"`
+		AudioCodecs  []string                    `json:"audio_codecs"`
+		AudioOptions transcoder.AudioOptions     `json:"audio_options"`
+		Subtitles    []transcoder.SubtitleTrack  `json:"subtitles"`
+		Captions     []transcoder.CaptionChannel `json:"captions"`
+		// DiskQuota overrides the configured per-stream quota, in bytes.
+		DiskQuota int64 `json:"disk_quota"`
 	} `json:"config"`
 }
 
@@ -42,7 +60,7 @@ func NewServer(address string) *Server {
 func (s *Server) AddRtmpRouter() {
 	// POST /rtmp resposible to create rtmp pull stream and generate
 	// hls stream
-	http.HandleFunc("POST /rtmp", func(w http.ResponseWriter, r *http.Request) {
+	handleFunc("POST /rtmp", func(w http.ResponseWriter, r *http.Request) {
 		decode := json.NewDecoder(r.Body)
 		var rtmpBody rtmpConfigHTTP
 		err := decode.Decode(&rtmpBody)
@@ -55,14 +73,26 @@ func (s *Server) AddRtmpRouter() {
 
 		zap.S().Infof("starting rtpm hlsproxy %+v", rtmpBody)
 		tscRunner := transcoder.NewTranscoder(rtmpBody.RtmpURL, rtmpBody.ID)
+		tscRunner.SetBackups(rtmpBody.BackupURLs)
+		tscRunner.SetSlate(rtmpBody.Slate)
 
 		zap.S().Infof("user specific config %+v", rtmpBody)
 		tscRunner.SetConfig(rtmpBody.Config.Varients, rtmpBody.Config.Audio, rtmpBody.Config.VideoCodec, rtmpBody.Config.AudioCodec)
+		tscRunner.SetEncoder(rtmpBody.Config.Encoder)
+		tscRunner.SetAudioTracks(rtmpBody.Config.AudioTracks)
+		tscRunner.SetAudioCodecs(rtmpBody.Config.AudioCodecs)
+		tscRunner.SetAudioOptions(rtmpBody.Config.AudioOptions)
+		tscRunner.SetSubtitleTracks(rtmpBody.Config.Subtitles)
+		tscRunner.SetCaptions(rtmpBody.Config.Captions)
 
-		_, err = tscRunner.Run()
+		if j := janitor.GetJanitor(); j != nil {
+			j.SetStreamQuota(rtmpBody.ID, rtmpBody.Config.DiskQuota)
+		}
+
+		_, err = tscRunner.Run(r.Context())
 		if err != nil {
-			w.WriteHeader(500)
-			w.Write([]byte("failed to register hlsproxy"))
+			w.WriteHeader(runStatus(err))
+			w.Write([]byte("failed to register hlsproxy: " + err.Error()))
 			return
 		}
 
@@ -71,7 +101,7 @@ func (s *Server) AddRtmpRouter() {
 	})
 
 	// DELETE /rtmp/{id} resposible to termanating running rtmp pulling stream
-	http.HandleFunc("DELETE /rtmp/", func(w http.ResponseWriter, r *http.Request) {
+	handleFunc("DELETE /rtmp/", func(w http.ResponseWriter, r *http.Request) {
 		id := r.URL.Query().Get("id")
 
 		if id == "" {
@@ -80,30 +110,224 @@ func (s *Server) AddRtmpRouter() {
 		}
 		zap.S().Infof("termanating running hls streaming ID:%s", id)
 
-		activeCmd := externalcmd.GloblaActiveCmds[id]
-		zap.S().Infof("total number of runnings hls streaming Count:%s \n current activeCmd: %s", len(externalcmd.GloblaActiveCmds), activeCmd)
+		tsc, ok := transcoder.Lookup(id)
+		zap.S().Infof("total number of runnings hls streaming Count:%d", transcoder.Count())
 
-		if activeCmd == nil {
+		if !ok {
 			w.WriteHeader(400)
 			w.Write([]byte("stream id not found"))
 			return
 		}
-		activeCmd.Close()
+		// ffmpeg gets SIGINT, its process group included
+		tsc.Stop()
+		if j := janitor.GetJanitor(); j != nil {
+			j.SetStreamQuota(id, 0)
+		}
 
-		zap.S().Infof("closing httpproxy gracefully...\ncmdstring: %s \nprocessid: %s", activeCmd.GetCmdString(), activeCmd.GetProcess().Pid)
-		syscall.Kill(-activeCmd.GetProcess().Pid, syscall.SIGINT)
-		err := activeCmd.GetProcess().Kill()
+		w.WriteHeader(200)
+		w.Write([]byte("success"))
+	})
+}
 
-		if err != nil {
-			zap.S().Errorf("failed to terminate hls stream ID:%s", activeCmd.StreamID)
+// runStatus returns the http status of a stream that failed to start.
+func runStatus(err error) int {
+	switch {
+	case errors.Is(err, transcoder.ErrReadyTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, transcoder.ErrFfmpegExited):
+		return http.StatusBadGateway
+	case errors.Is(err, transcoder.ErrNoCapacity):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, transcoder.ErrStreamExists):
+		return http.StatusConflict
+	case errors.Is(err, context.Canceled):
+		// the client went away, nobody reads the status
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+type streamStatusHTTP struct {
+	ID       string                      `json:"id"`
+	State    string                      `json:"state"`
+	Degraded []string                    `json:"degraded,omitempty"`
+	Source   int                         `json:"source"`
+	Pid      int                         `json:"pid,omitempty"`
+	LastExit *externalcmd.ExitResult     `json:"last_exit,omitempty"`
+	Restarts []externalcmd.RestartRecord `json:"restarts"`
+	Progress transcoder.Progress         `json:"progress"`
+	Disk     *janitor.Usage              `json:"disk,omitempty"`
+}
+
+type storageUsageHTTP struct {
+	TotalBytes  int64                    `json:"total_bytes"`
+	GlobalQuota int64                    `json:"global_quota,omitempty"`
+	Streams     map[string]janitor.Usage `json:"streams"`
+	Memory      *storage.MemoryStats     `json:"memory,omitempty"`
+}
+
+// AddStreamsRouter exposes the runtime status and logs of registered streams
+// GET /streams/{id}
+// GET /streams/{id}/logs?tail=100&follow=true
+// GET /storage/usage
+func (s *Server) AddStreamsRouter() {
+	handleFunc("GET /storage/usage", func(w http.ResponseWriter, r *http.Request) {
+		j := janitor.GetJanitor()
+		if j == nil {
+			w.WriteHeader(503)
+			w.Write([]byte("janitor is not running"))
+			return
 		}
-		zap.S().Infof("closed processid: %s", activeCmd.GetProcess().Pid)
-		delete(externalcmd.GloblaActiveCmds, id)
 
-		os.RemoveAll(config.GetConfig("").Config.Output.Dirname + "/" + id)
+		streams, total := j.Usage()
+		usage := storageUsageHTTP{
+			TotalBytes:  total,
+			GlobalQuota: config.GetConfig("").Config.Output.Retention.GlobalQuota,
+			Streams:     streams,
+		}
+		if memory, ok := storage.GetStorage().(*storage.Memory); ok {
+			stats := memory.Stats()
+			usage.Memory = &stats
+		}
 
-		w.WriteHeader(200)
-		w.Write([]byte("success"))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(usage)
+	})
+
+	handleFunc("GET /streams/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		tsc, ok := transcoder.Lookup(id)
+		if !ok || tsc.Cmd() == nil {
+			w.WriteHeader(404)
+			w.Write([]byte("stream id not found"))
+			return
+		}
+
+		activeCmd := tsc.Cmd()
+		status := streamStatusHTTP{
+			ID:       id,
+			State:    tsc.State(),
+			Degraded: tsc.Degraded(),
+			Source:   tsc.SourceIndex(),
+			LastExit: activeCmd.LastExit(),
+			Restarts: activeCmd.RestartHistory(),
+			Progress: tsc.Progress(),
+		}
+		if process := activeCmd.GetProcess(); process != nil {
+			status.Pid = process.Pid
+		}
+		if j := janitor.GetJanitor(); j != nil {
+			if usage, ok := j.StreamUsage(id); ok {
+				status.Disk = &usage
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+
+	handleFunc("GET /streams/{id}/logs", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		tsc, ok := transcoder.Lookup(id)
+		if !ok || tsc.Logs == nil {
+			w.WriteHeader(404)
+			w.Write([]byte("stream id not found"))
+			return
+		}
+
+		tail := 100
+		if v := r.URL.Query().Get("tail"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				w.WriteHeader(400)
+				w.Write([]byte("tail must be a number"))
+				return
+			}
+			tail = n
+		}
+		follow, _ := strconv.ParseBool(r.URL.Query().Get("follow"))
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if !follow {
+			for _, line := range tsc.Logs.Tail(tail) {
+				fmt.Fprintln(w, line.Text)
+			}
+			return
+		}
+
+		lines, next, stop := tsc.Logs.Follow(tail)
+		defer stop()
+
+		flusher, _ := w.(http.Flusher)
+		for _, line := range lines {
+			fmt.Fprintln(w, line.Text)
+		}
+		for {
+			if flusher != nil {
+				flusher.Flush()
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			case line, ok := <-next:
+				if !ok {
+					return
+				}
+				fmt.Fprintln(w, line.Text)
+			}
+		}
+	})
+}
+
+// AddIngestRouter receives the hls output ffmpeg uploads with -method PUT,
+// only from loopback clients. The segment muxer of the subtitles can't be
+// told the method and POSTs.
+// PUT /ingest/{id}/{path...}
+// POST /ingest/{id}/{path...}
+// DELETE /ingest/{id}/{path...}
+func (s *Server) AddIngestRouter() {
+	ingest := func(w http.ResponseWriter, r *http.Request) (*transcoder.Transcoder, string, bool) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			w.WriteHeader(403)
+			w.Write([]byte("ingest is only accepted from loopback"))
+			return nil, "", false
+		}
+		tsc, ok := transcoder.Lookup(r.PathValue("id"))
+		if !ok {
+			w.WriteHeader(404)
+			w.Write([]byte("stream id not found"))
+			return nil, "", false
+		}
+		return tsc, r.PathValue("path"), true
+	}
+
+	put := func(w http.ResponseWriter, r *http.Request) {
+		tsc, name, ok := ingest(w, r)
+		if !ok {
+			return
+		}
+		if err := tsc.Ingest(r.Context(), name, r.Body, r.ContentLength); err != nil {
+			zap.S().Errorf("failed to ingest %s of stream %s, Error: %s", name, tsc.ID, err)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(201)
+	}
+	handleFunc("PUT /ingest/{id}/{path...}", put)
+	handleFunc("POST /ingest/{id}/{path...}", put)
+
+	handleFunc("DELETE /ingest/{id}/{path...}", func(w http.ResponseWriter, r *http.Request) {
+		tsc, name, ok := ingest(w, r)
+		if !ok {
+			return
+		}
+		if err := tsc.IngestDelete(r.Context(), name); err != nil {
+			zap.S().Errorf("failed to delete %s of stream %s, Error: %s", name, tsc.ID, err)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(204)
 	})
 }
 
@@ -111,7 +335,7 @@ func (s *Server) AddRtmpRouter() {
 // handling input as HLS only
 // GET /*.m3u8
 func (s *Server) AddHlsRouter() {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	handleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		sourceHlsURL := r.URL
 		originServerHost, _ := url.Parse(config.GetConfig("").Config.OriginServer.URL)
 		sourceHlsURL.Host = originServerHost.Host
@@ -120,13 +344,16 @@ func (s *Server) AddHlsRouter() {
 
 		id := uuid.New().String()
 		transcoderRunner := transcoder.NewTranscoder(sourceHlsURL.String(), id)
-		m3u8string, err := transcoderRunner.Run()
+		m3u8string, err := transcoderRunner.Run(r.Context())
 		if err != nil {
 			zap.S().Errorf("failed to start trasncoder, Error: %s", err)
+			w.WriteHeader(runStatus(err))
+			w.Write([]byte(err.Error()))
+			return
 		}
 
-		w.WriteHeader(200)
 		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.WriteHeader(200)
 		w.Write([]byte(m3u8string))
 	})
 }
@@ -138,8 +365,13 @@ func (s *Server) AddFSServerRouter() {
 	wd, _ := os.Getwd()
 	fspath := path.Join(wd, config.GlobalConfigInstance.Config.Output.Dirname)
 	zap.S().Infof("registering file server %s", fspath)
-	fs := http.FileServer(http.Dir(fspath))
-	http.Handle("/hlsproxy/", http.StripPrefix("/hlsproxy", fs))
+	// media playlists of restarted streams get their discontinuities marked
+	fs := transcoder.PlaylistHandler(fspath, http.FileServer(http.Dir(fspath)))
+	if memory, ok := storage.GetStorage().(*storage.Memory); ok {
+		// serving from RAM, falling back to the disk for the master playlist
+		fs = memory.Handler(fs)
+	}
+	handle("/hlsproxy/", http.StripPrefix("/hlsproxy", fs))
 }
 
 func (s *Server) StartAndListen() {
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/meanii/hlsproxy/internal/metrics"
+	"github.com/meanii/hlsproxy/internal/transcoder"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// handle registers handler on the default mux, instrumented with the
+// pattern as route label and span name.
+func handle(pattern string, handler http.Handler) {
+	http.Handle(pattern, metrics.InstrumentHandler(pattern, otelhttp.NewHandler(handler, pattern)))
+}
+
+func handleFunc(pattern string, handler http.HandlerFunc) {
+	handle(pattern, handler)
+}
+
+// AddMetricsRouter exposes the Prometheus metrics
+// GET /metrics
+func (s *Server) AddMetricsRouter() {
+	metrics.SetStreamStates(transcoder.StateCounts)
+	http.Handle("GET /metrics", metrics.Handler())
+}
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/meanii/hlsproxy/internal/webhook"
+)
+
+// AddWebhookRouter exposes the delivery log of the configured webhooks
+// GET /webhooks/deliveries
+func (s *Server) AddWebhookRouter() {
+	handleFunc("GET /webhooks/deliveries", func(w http.ResponseWriter, r *http.Request) {
+		d := webhook.GetDispatcher()
+		if d == nil {
+			w.WriteHeader(503)
+			w.Write([]byte("webhooks aren't running"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d.Deliveries())
+	})
+}
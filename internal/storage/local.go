@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Local stores objects as files under a root directory, served by the
+// proxy's own file server at baseURL.
+type Local struct {
+	root    string
+	baseURL string
+}
+
+// NewLocal allocates a Local storage. A relative root is resolved against
+// the working directory.
+func NewLocal(root string, baseURL string) *Local {
+	if !filepath.IsAbs(root) {
+		wd, _ := os.Getwd()
+		root = filepath.Join(wd, root)
+	}
+	return &Local{root: root, baseURL: baseURL}
+}
+
+// Root returns the directory objects are stored in.
+func (l *Local) Root() string {
+	return l.root
+}
+
+func (l *Local) path(key string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(key)) {
+		return "", errors.New("storage: key escapes the storage root")
+	}
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
+
+// Put writes the object to a temporary file first and renames it, so
+// readers never see a partial object.
+func (l *Local) Put(_ context.Context, key string, r io.Reader, _ int64, _ string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// Check verifies the root directory is writable.
+func (l *Local) Check(_ context.Context) error {
+	if err := os.MkdirAll(l.root, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(l.root, ".check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func (l *Local) Delete(_ context.Context, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (l *Local) URL(key string) string {
+	return joinURL(l.baseURL, key)
+}
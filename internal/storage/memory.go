@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultMemoryCapacity = 512 << 20
+
+// Memory keeps objects in RAM, evicting the least recently used ones once
+// capacity bytes are exceeded. Objects are served by Handler straight from
+// the stored slices, which are never modified once put.
+type Memory struct {
+	capacity int64
+	baseURL  string
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	objects map[string]*list.Element
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+type memoryObject struct {
+	key         string
+	data        []byte
+	contentType string
+	modTime     time.Time
+}
+
+// MemoryStats describes the state of a Memory storage.
+type MemoryStats struct {
+	Objects   int   `json:"objects"`
+	Bytes     int64 `json:"bytes"`
+	Capacity  int64 `json:"capacity"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+}
+
+// NewMemory allocates a Memory storage holding up to capacity bytes,
+// served by the proxy at baseURL.
+func NewMemory(capacity int64, baseURL string) *Memory {
+	if capacity <= 0 {
+		capacity = defaultMemoryCapacity
+	}
+	return &Memory{
+		capacity: capacity,
+		baseURL:  baseURL,
+		lru:      list.New(),
+		objects:  make(map[string]*list.Element),
+	}
+}
+
+func (m *Memory) Put(_ context.Context, key string, r io.Reader, size int64, contentType string) error {
+	var buf bytes.Buffer
+	if size > 0 {
+		buf.Grow(int(size))
+	}
+	if _, err := io.Copy(&buf, r); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if int64(len(data)) > m.capacity {
+		return fmt.Errorf("storage: %s is larger than the memory capacity", key)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.remove(key)
+	object := &memoryObject{key: key, data: data, contentType: contentType, modTime: time.Now()}
+	m.objects[key] = m.lru.PushFront(object)
+	m.size += int64(len(data))
+
+	for m.size > m.capacity {
+		oldest := m.lru.Back()
+		evicted := oldest.Value.(*memoryObject)
+		zap.S().Debugf("storage: evicting %s from memory", evicted.key)
+		m.remove(evicted.key)
+		m.evictions.Add(1)
+	}
+	return nil
+}
+
+func (m *Memory) Delete(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(key)
+	return nil
+}
+
+// remove drops key, m.mu must be held.
+func (m *Memory) remove(key string) {
+	elem, ok := m.objects[key]
+	if !ok {
+		return
+	}
+	m.lru.Remove(elem)
+	delete(m.objects, key)
+	m.size -= int64(len(elem.Value.(*memoryObject).data))
+}
+
+func (m *Memory) URL(key string) string {
+	return joinURL(m.baseURL, key)
+}
+
+// get returns the object stored under key and marks it as recently used.
+func (m *Memory) get(key string) (*memoryObject, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	elem, ok := m.objects[key]
+	if !ok {
+		m.misses.Add(1)
+		return nil, false
+	}
+	m.lru.MoveToFront(elem)
+	m.hits.Add(1)
+	return elem.Value.(*memoryObject), true
+}
+
+// Stats returns the current usage and hit counters.
+func (m *Memory) Stats() MemoryStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return MemoryStats{
+		Objects:   len(m.objects),
+		Bytes:     m.size,
+		Capacity:  m.capacity,
+		Hits:      m.hits.Load(),
+		Misses:    m.misses.Load(),
+		Evictions: m.evictions.Load(),
+	}
+}
+
+// Handler serves objects by the request path, which must be relative to
+// the storage root. Missing objects are passed on to fallback, if any.
+func (m *Memory) Handler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+		object, ok := m.get(key)
+		if !ok {
+			if fallback != nil {
+				fallback.ServeHTTP(w, r)
+				return
+			}
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", object.contentType)
+		if path.Ext(key) == ".m3u8" {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		http.ServeContent(w, r, key, object.modTime, bytes.NewReader(object.data))
+	})
+}
+
+// IsMemory reports whether s keeps objects in RAM.
+func IsMemory(s Storage) bool {
+	_, ok := s.(*Memory)
+	return ok
+}
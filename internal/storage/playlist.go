@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"bytes"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var uriAttribute = regexp.MustCompile(`URI="([^"]*)"`)
+
+// playlistURIs returns every URI referenced by an m3u8 playlist, both
+// media lines and URI attributes of tags such as EXT-X-MAP.
+func playlistURIs(data []byte) []string {
+	var uris []string
+	rewritePlaylist(data, func(uri string) string {
+		uris = append(uris, uri)
+		return uri
+	})
+	return uris
+}
+
+// rewritePlaylist replaces every URI of an m3u8 playlist with the result
+// of rewrite.
+func rewritePlaylist(data []byte, rewrite func(uri string) string) []byte {
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		text := strings.TrimRight(string(line), "\r")
+		switch {
+		case text == "":
+		case strings.HasPrefix(text, "#"):
+			text = uriAttribute.ReplaceAllStringFunc(text, func(attr string) string {
+				uri := uriAttribute.FindStringSubmatch(attr)[1]
+				return `URI="` + rewrite(uri) + `"`
+			})
+		default:
+			text = rewrite(text)
+		}
+		lines[i] = []byte(text)
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// resolveKey returns the key of uri referenced from the playlist stored
+// under playlistKey, false for absolute URLs.
+func resolveKey(playlistKey, uri string) (string, bool) {
+	if strings.Contains(uri, "://") || strings.HasPrefix(uri, "/") {
+		return "", false
+	}
+	return path.Join(path.Dir(playlistKey), uri), true
+}
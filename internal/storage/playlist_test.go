@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+const mediaPlaylist = `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:4
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:2.000000,
+004.m4s
+#EXTINF:2.000000,
+005.m4s
+`
+
+func TestPlaylistURIs(t *testing.T) {
+	want := []string{"init.mp4", "004.m4s", "005.m4s"}
+	if got := playlistURIs([]byte(mediaPlaylist)); !reflect.DeepEqual(got, want) {
+		t.Errorf("playlistURIs() = %q, want %q", got, want)
+	}
+}
+
+func TestRewritePlaylist(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "media",
+			in:   mediaPlaylist,
+			want: `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:4
+#EXT-X-MAP:URI="https://cdn/init.mp4"
+#EXTINF:2.000000,
+https://cdn/004.m4s
+#EXTINF:2.000000,
+https://cdn/005.m4s
+`,
+		},
+		{
+			name: "master with alternatives",
+			in: "#EXTM3U\r\n" +
+				"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aac\",NAME=\"en\",URI=\"audio/audio.m3u8\"\r\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=500000,AUDIO=\"aac\"\r\n" +
+				"360p/360p.m3u8\r\n",
+			want: "#EXTM3U\n" +
+				"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aac\",NAME=\"en\",URI=\"https://cdn/audio/audio.m3u8\"\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=500000,AUDIO=\"aac\"\n" +
+				"https://cdn/360p/360p.m3u8\n",
+		},
+		{
+			name: "blank lines",
+			in:   "#EXTM3U\n\n\n",
+			want: "#EXTM3U\n\n\n",
+		},
+	}
+	for _, tt := range tests {
+		got := rewritePlaylist([]byte(tt.in), func(uri string) string { return "https://cdn/" + uri })
+		if string(got) != tt.want {
+			t.Errorf("%s: rewritePlaylist() =\n%q\nwant\n%q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResolveKey(t *testing.T) {
+	tests := []struct {
+		playlist string
+		uri      string
+		key      string
+		ok       bool
+	}{
+		{playlist: "id/720p/720p.m3u8", uri: "001.ts", key: "id/720p/001.ts", ok: true},
+		{playlist: "id/playlist.m3u8", uri: "720p/720p.m3u8", key: "id/720p/720p.m3u8", ok: true},
+		{playlist: "id/subs_0/subs_0.m3u8", uri: "../720p/init.mp4", key: "id/720p/init.mp4", ok: true},
+		{playlist: "id/720p/720p.m3u8", uri: "./002.ts", key: "id/720p/002.ts", ok: true},
+		{playlist: "id/720p/720p.m3u8", uri: "https://cdn/001.ts", ok: false},
+		{playlist: "id/720p/720p.m3u8", uri: "/hlsproxy/id/720p/001.ts", ok: false},
+	}
+	for _, tt := range tests {
+		key, ok := resolveKey(tt.playlist, tt.uri)
+		if key != tt.key || ok != tt.ok {
+			t.Errorf("resolveKey(%q, %q) = %q, %v, want %q, %v", tt.playlist, tt.uri, key, ok, tt.key, tt.ok)
+		}
+	}
+}
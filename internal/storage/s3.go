@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/meanii/hlsproxy/config"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3 stores objects in a bucket of any S3-compatible object storage.
+type S3 struct {
+	client    *minio.Client
+	bucket    string
+	prefix    string
+	publicURL string
+}
+
+// NewS3 connects to the configured endpoint. Objects are fetched from
+// PublicURL, e.g. a CDN in front of the bucket, or from the bucket itself
+// when it's empty.
+func NewS3(cfg config.S3Config) (*S3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 endpoint and bucket are required")
+	}
+
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	publicURL := cfg.PublicURL
+	if publicURL == "" {
+		scheme := "http"
+		if cfg.UseSSL {
+			scheme = "https"
+		}
+		publicURL = fmt.Sprintf("%s://%s/%s", scheme, cfg.Endpoint, path.Join(cfg.Bucket, cfg.Prefix))
+	}
+
+	return &S3{
+		client:    client,
+		bucket:    cfg.Bucket,
+		prefix:    strings.Trim(cfg.Prefix, "/"),
+		publicURL: publicURL,
+	}, nil
+}
+
+func (s *S3) object(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return s.prefix + "/" + key
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	opts := minio.PutObjectOptions{ContentType: contentType}
+	// live playlists change every segment, segments never do
+	if strings.HasSuffix(key, ".m3u8") {
+		opts.CacheControl = "no-cache"
+	} else {
+		opts.CacheControl = "public, max-age=3600"
+	}
+	_, err := s.client.PutObject(ctx, s.bucket, s.object(key), r, size, opts)
+	return err
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, s.object(key), minio.RemoveObjectOptions{})
+}
+
+// Check verifies the bucket is reachable with the configured credentials.
+func (s *S3) Check(ctx context.Context) error {
+	exists, err := s.client.BucketExists(ctx, s.bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("bucket %s doesn't exist", s.bucket)
+	}
+	return nil
+}
+
+func (s *S3) URL(key string) string {
+	return joinURL(s.publicURL, key)
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meanii/hlsproxy/config"
+	"github.com/minio/minio-go/v7"
+)
+
+// minioConfig returns the MinIO the S3 tests run against, skipping them
+// when it isn't reachable. Start one with
+//
+//	docker run --rm -p 9000:9000 minio/minio server /data
+//
+// or point HLSPROXY_TEST_S3_ENDPOINT at another one.
+func minioConfig(t *testing.T) config.S3Config {
+	t.Helper()
+	cfg := config.S3Config{
+		Endpoint:  getenv("HLSPROXY_TEST_S3_ENDPOINT", "localhost:9000"),
+		Region:    "us-east-1",
+		Bucket:    getenv("HLSPROXY_TEST_S3_BUCKET", "hlsproxy-test"),
+		Prefix:    "live",
+		AccessKey: getenv("HLSPROXY_TEST_S3_ACCESS_KEY", "minioadmin"),
+		SecretKey: getenv("HLSPROXY_TEST_S3_SECRET_KEY", "minioadmin"),
+	}
+	conn, err := net.DialTimeout("tcp", cfg.Endpoint, time.Second)
+	if err != nil {
+		t.Skipf("minio isn't available at %s: %s", cfg.Endpoint, err)
+	}
+	conn.Close()
+	return cfg
+}
+
+func getenv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// newTestS3 returns an S3 storage on a bucket created for the test.
+func newTestS3(t *testing.T) *S3 {
+	t.Helper()
+	cfg := minioConfig(t)
+	s3, err := NewS3(cfg)
+	if err != nil {
+		t.Fatalf("NewS3() error = %v", err)
+	}
+	ctx := context.Background()
+	exists, err := s3.client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		t.Skipf("minio at %s isn't usable: %s", cfg.Endpoint, err)
+	}
+	if !exists {
+		if err := s3.client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region}); err != nil {
+			t.Fatalf("MakeBucket() error = %v", err)
+		}
+	}
+	return s3
+}
+
+// getObject reads key back from the bucket, false when it doesn't exist.
+func (s *S3) getObject(t *testing.T, key string) ([]byte, minio.ObjectInfo, bool) {
+	t.Helper()
+	object, err := s.client.GetObject(context.Background(), s.bucket, s.object(key), minio.GetObjectOptions{})
+	if err != nil {
+		t.Fatalf("GetObject(%s) error = %v", key, err)
+	}
+	defer object.Close()
+	data, err := io.ReadAll(object)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, minio.ObjectInfo{}, false
+		}
+		t.Fatalf("reading %s: %v", key, err)
+	}
+	info, err := object.Stat()
+	if err != nil {
+		t.Fatalf("Stat(%s) error = %v", key, err)
+	}
+	return data, info, true
+}
+
+func TestS3(t *testing.T) {
+	s3 := newTestS3(t)
+	ctx := context.Background()
+	if err := s3.Check(ctx); err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+
+	tests := []struct {
+		key          string
+		data         string
+		cacheControl string
+	}{
+		{key: "s3test/720p/720p.m3u8", data: "#EXTM3U\n", cacheControl: "no-cache"},
+		{key: "s3test/720p/001.ts", data: "segment", cacheControl: "public, max-age=3600"},
+	}
+	for _, tt := range tests {
+		if err := s3.Put(ctx, tt.key, strings.NewReader(tt.data), int64(len(tt.data)), ContentType(tt.key)); err != nil {
+			t.Fatalf("Put(%s) error = %v", tt.key, err)
+		}
+		data, info, ok := s3.getObject(t, tt.key)
+		if !ok || string(data) != tt.data {
+			t.Errorf("%s = %q, %v, want %q", tt.key, data, ok, tt.data)
+		}
+		if info.ContentType != ContentType(tt.key) {
+			t.Errorf("%s content type = %q, want %q", tt.key, info.ContentType, ContentType(tt.key))
+		}
+		if got := info.Metadata.Get("Cache-Control"); got != tt.cacheControl {
+			t.Errorf("%s cache control = %q, want %q", tt.key, got, tt.cacheControl)
+		}
+		if want := "http://" + minioConfig(t).Endpoint + "/" + s3.bucket + "/live/" + tt.key; s3.URL(tt.key) != want {
+			t.Errorf("URL(%s) = %q, want %q", tt.key, s3.URL(tt.key), want)
+		}
+
+		if err := s3.Delete(ctx, tt.key); err != nil {
+			t.Fatalf("Delete(%s) error = %v", tt.key, err)
+		}
+		if _, _, ok := s3.getObject(t, tt.key); ok {
+			t.Errorf("%s still exists after Delete", tt.key)
+		}
+	}
+	// deleting a missing key isn't an error
+	if err := s3.Delete(ctx, "s3test/missing.ts"); err != nil {
+		t.Errorf("Delete() of a missing key error = %v", err)
+	}
+}
+
+func TestSyncerS3(t *testing.T) {
+	s3 := newTestS3(t)
+	testSyncer(t, s3, func(key string) ([]byte, bool) {
+		data, _, ok := s3.getObject(t, key)
+		return data, ok
+	})
+}
@@ -0,0 +1,96 @@
+// Package storage stores the segments and playlists of the streams and
+// tells where players can fetch them from.
+package storage
+
+import (
+	"context"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/meanii/hlsproxy/config"
+	"go.uber.org/zap"
+)
+
+// Storage is a backend for stream objects. Keys are slash separated paths
+// relative to the output root, e.g. "<stream id>/720p/001.ts".
+type Storage interface {
+	// Put stores size bytes read from r under key.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Delete removes key, deleting a missing key isn't an error.
+	Delete(ctx context.Context, key string) error
+	// URL returns the URL players fetch key from.
+	URL(key string) string
+}
+
+// Checker is implemented by storages able to tell whether they can
+// currently store objects.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+const defaultBaseURL = "http://localhost:8001/hlsproxy/"
+
+var (
+	instance Storage
+	once     sync.Once
+)
+
+// GetStorage returns the storage configured in config.yaml, local disk
+// under the output dirname by default, RAM or an S3 bucket otherwise.
+func GetStorage() Storage {
+	once.Do(func() {
+		output := config.GetConfig("").Config.Output
+		switch output.Storage.Type {
+		case "s3":
+			s3, err := NewS3(output.Storage.S3)
+			if err != nil {
+				zap.S().Fatalf("storage: couldn't set up s3 storage, Error: %s", err)
+			}
+			zap.S().Infof("storage: using s3 bucket %s at %s", output.Storage.S3.Bucket, output.Storage.S3.Endpoint)
+			instance = s3
+		case "memory":
+			memory := NewMemory(output.Storage.Memory.Capacity, baseURL(output.BaseURL))
+			zap.S().Infof("storage: keeping segments in memory, capacity %d bytes", memory.capacity)
+			instance = memory
+		default:
+			instance = NewLocal(output.Dirname, baseURL(output.BaseURL))
+		}
+	})
+	return instance
+}
+
+// baseURL returns the configured base URL of objects served by the proxy.
+func baseURL(configured string) string {
+	if configured == "" {
+		return defaultBaseURL
+	}
+	return configured
+}
+
+// IsLocal reports whether s serves objects straight from the output directory.
+func IsLocal(s Storage) bool {
+	_, ok := s.(*Local)
+	return ok
+}
+
+// ContentType returns the content type of an hls object by its extension.
+func ContentType(key string) string {
+	switch strings.ToLower(path.Ext(key)) {
+	case ".m3u8":
+		return "application/vnd.apple.mpegurl"
+	case ".ts":
+		return "video/mp2t"
+	case ".m4s", ".mp4":
+		return "video/mp4"
+	case ".vtt":
+		return "text/vtt"
+	}
+	return "application/octet-stream"
+}
+
+// joinURL appends key to base, with exactly one slash between them.
+func joinURL(base, key string) string {
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(key, "/")
+}
@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	syncInterval   = 500 * time.Millisecond
+	cleanupTimeout = 30 * time.Second
+)
+
+// Syncer mirrors the hls output ffmpeg writes to a local stream directory
+// into a remote Storage. Segments are uploaded once a playlist lists them,
+// i.e. once ffmpeg finished writing them, and playlists are rewritten to
+// point at the storage URLs.
+type Syncer struct {
+	store    Storage
+	root     string
+	streamID string
+
+	// playlists holds the last uploaded content and referenced keys per playlist
+	playlists map[string]syncedPlaylist
+	uploaded  map[string]bool
+	// filter edits the playlists and WebVTT segments before they are uploaded
+	filter func(key string, data []byte) []byte
+}
+
+type syncedPlaylist struct {
+	data []byte
+	keys []string
+}
+
+// NewSyncer allocates a Syncer for the stream stored under root/streamID.
+func NewSyncer(store Storage, root string, streamID string) *Syncer {
+	return &Syncer{
+		store:     store,
+		root:      root,
+		streamID:  streamID,
+		playlists: make(map[string]syncedPlaylist),
+		uploaded:  make(map[string]bool),
+	}
+}
+
+// SetFilter sets a function editing the playlists and WebVTT segments,
+// keyed relative to root, before they are uploaded.
+func (s *Syncer) SetFilter(filter func(key string, data []byte) []byte) {
+	s.filter = filter
+}
+
+// Run syncs until ctx is done, then deletes everything it uploaded.
+func (s *Syncer) Run(ctx context.Context) {
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.cleanup()
+			return
+		case <-ticker.C:
+			s.syncOnce(ctx)
+		}
+	}
+}
+
+func (s *Syncer) syncOnce(ctx context.Context) {
+	dir := filepath.Join(s.root, s.streamID)
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(p) != ".m3u8" {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return nil
+		}
+		if err := s.syncPlaylist(ctx, filepath.ToSlash(rel), p); err != nil {
+			zap.S().Warnf("storage: failed to sync %s, Error: %s", rel, err)
+		}
+		return nil
+	})
+}
+
+func (s *Syncer) syncPlaylist(ctx context.Context, key string, file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	previous := s.playlists[key]
+	if bytes.Equal(previous.data, data) {
+		return nil
+	}
+
+	var keys []string
+	for _, uri := range playlistURIs(data) {
+		objectKey, ok := resolveKey(key, uri)
+		if !ok || strings.HasSuffix(objectKey, ".m3u8") || s.uploaded[objectKey] {
+			continue
+		}
+		if err := s.upload(ctx, objectKey); err != nil {
+			return err
+		}
+		keys = append(keys, objectKey)
+	}
+
+	source := data
+	if s.filter != nil {
+		source = s.filter(key, data)
+	}
+	rewritten := rewritePlaylist(source, func(uri string) string {
+		objectKey, ok := resolveKey(key, uri)
+		if !ok {
+			return uri
+		}
+		return s.store.URL(objectKey)
+	})
+	if err := s.store.Put(ctx, key, bytes.NewReader(rewritten), int64(len(rewritten)), ContentType(key)); err != nil {
+		return err
+	}
+
+	// segments dropped from the sliding window are gone from the playlist
+	// now, delete them from the storage too
+	current := make(map[string]bool)
+	for _, uri := range playlistURIs(data) {
+		if objectKey, ok := resolveKey(key, uri); ok {
+			current[objectKey] = true
+		}
+	}
+	kept := keys
+	for _, objectKey := range previous.keys {
+		if current[objectKey] {
+			kept = append(kept, objectKey)
+			continue
+		}
+		if err := s.store.Delete(ctx, objectKey); err != nil {
+			zap.S().Warnf("storage: failed to delete %s, Error: %s", objectKey, err)
+		}
+		delete(s.uploaded, objectKey)
+	}
+
+	s.playlists[key] = syncedPlaylist{data: data, keys: kept}
+	return nil
+}
+
+func (s *Syncer) upload(ctx context.Context, key string) error {
+	if s.filter != nil && path.Ext(key) == ".vtt" {
+		data, err := os.ReadFile(filepath.Join(s.root, filepath.FromSlash(key)))
+		if err != nil {
+			return err
+		}
+		data = s.filter(key, data)
+		if err := s.store.Put(ctx, key, bytes.NewReader(data), int64(len(data)), ContentType(key)); err != nil {
+			return err
+		}
+		s.uploaded[key] = true
+		return nil
+	}
+
+	file, err := os.Open(filepath.Join(s.root, filepath.FromSlash(key)))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := s.store.Put(ctx, key, file, info.Size(), ContentType(key)); err != nil {
+		return err
+	}
+	s.uploaded[key] = true
+	return nil
+}
+
+func (s *Syncer) cleanup() {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+
+	keys := make([]string, 0, len(s.uploaded)+len(s.playlists))
+	for key := range s.uploaded {
+		keys = append(keys, key)
+	}
+	for key := range s.playlists {
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		if err := s.store.Delete(ctx, key); err != nil {
+			zap.S().Warnf("storage: failed to delete %s, Error: %s", key, err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writeFile writes data under root, creating the directories.
+func writeFile(t *testing.T, root, name, data string) {
+	t.Helper()
+	p := filepath.Join(root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func livePlaylist(sequence int, segments ...string) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:" + strconv.Itoa(sequence) + "\n")
+	for _, segment := range segments {
+		b.WriteString("#EXTINF:2.000000,\n" + segment + "\n")
+	}
+	return b.String()
+}
+
+// testSyncer mirrors a stream directory into store and checks the objects
+// read back with get, missing objects returning false.
+func testSyncer(t *testing.T, store Storage, get func(key string) ([]byte, bool)) {
+	ctx := context.Background()
+	root := t.TempDir()
+	writeFile(t, root, "id/720p/001.ts", "segment 1")
+	writeFile(t, root, "id/720p/002.ts", "segment 2")
+	writeFile(t, root, "id/720p/003.ts", "partial segment 3")
+	writeFile(t, root, "id/720p/720p.m3u8", livePlaylist(1, "001.ts", "002.ts"))
+	writeFile(t, root, "id/subs_0/001.vtt", "WEBVTT\n")
+	writeFile(t, root, "id/subs_0/subs_0.m3u8", livePlaylist(1, "001.vtt"))
+
+	syncer := NewSyncer(store, root, "id")
+	syncer.SetFilter(func(key string, data []byte) []byte {
+		return append(data, []byte("# filtered "+key+"\n")...)
+	})
+	syncer.syncOnce(ctx)
+
+	for key, want := range map[string]string{
+		"id/720p/001.ts":    "segment 1",
+		"id/720p/002.ts":    "segment 2",
+		"id/subs_0/001.vtt": "WEBVTT\n# filtered id/subs_0/001.vtt\n",
+	} {
+		if got, ok := get(key); !ok || string(got) != want {
+			t.Errorf("%s = %q, %v, want %q", key, got, ok, want)
+		}
+	}
+	// segments are uploaded once listed, i.e. complete
+	if _, ok := get("id/720p/003.ts"); ok {
+		t.Error("unlisted segment id/720p/003.ts was uploaded")
+	}
+	playlist, ok := get("id/720p/720p.m3u8")
+	if !ok {
+		t.Fatal("playlist id/720p/720p.m3u8 wasn't uploaded")
+	}
+	for _, want := range []string{store.URL("id/720p/001.ts"), store.URL("id/720p/002.ts"), "# filtered id/720p/720p.m3u8"} {
+		if !bytes.Contains(playlist, []byte(want)) {
+			t.Errorf("playlist misses %q:\n%s", want, playlist)
+		}
+	}
+
+	// the window slides, the dropped segment is deleted
+	writeFile(t, root, "id/720p/720p.m3u8", livePlaylist(2, "002.ts", "003.ts"))
+	syncer.syncOnce(ctx)
+	if _, ok := get("id/720p/001.ts"); ok {
+		t.Error("segment id/720p/001.ts dropped from the playlist wasn't deleted")
+	}
+	if got, ok := get("id/720p/003.ts"); !ok || string(got) != "partial segment 3" {
+		t.Errorf("id/720p/003.ts = %q, %v once listed", got, ok)
+	}
+
+	syncer.cleanup()
+	for _, key := range []string{"id/720p/002.ts", "id/720p/003.ts", "id/720p/720p.m3u8", "id/subs_0/001.vtt", "id/subs_0/subs_0.m3u8"} {
+		if _, ok := get(key); ok {
+			t.Errorf("%s left behind after cleanup", key)
+		}
+	}
+}
+
+func TestSyncerMemory(t *testing.T) {
+	store := NewMemory(1<<20, "http://proxy/hlsproxy/")
+	testSyncer(t, store, func(key string) ([]byte, bool) {
+		object, ok := store.get(key)
+		if !ok {
+			return nil, false
+		}
+		return object.data, true
+	})
+}
@@ -0,0 +1,123 @@
+// Package streamlog captures the output of a stream's external command.
+package streamlog
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// Line is a single line of captured output.
+type Line struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Text string    `json:"text"`
+}
+
+// Buffer is an io.Writer keeping the last lines written to it in a ring,
+// optionally mirroring them to a file. Followers get every new line.
+type Buffer struct {
+	mu      sync.Mutex
+	lines   []Line
+	start   int
+	seq     uint64
+	partial []byte
+	file    io.Writer
+	subs    map[chan Line]struct{}
+}
+
+// NewBuffer allocates a Buffer holding up to size lines. file may be nil.
+func NewBuffer(size int, file io.Writer) *Buffer {
+	if size < 1 {
+		size = 1
+	}
+	return &Buffer{
+		lines: make([]Line, 0, size),
+		file:  file,
+		subs:  make(map[chan Line]struct{}),
+	}
+}
+
+func (b *Buffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	buf := append(b.partial, p...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		b.push(string(bytes.TrimRight(buf[:i], "\r")))
+		buf = buf[i+1:]
+	}
+	b.partial = append([]byte(nil), buf...)
+	return len(p), nil
+}
+
+func (b *Buffer) push(text string) {
+	b.seq++
+	line := Line{Seq: b.seq, Time: time.Now(), Text: text}
+
+	if len(b.lines) < cap(b.lines) {
+		b.lines = append(b.lines, line)
+	} else {
+		b.lines[b.start] = line
+		b.start = (b.start + 1) % len(b.lines)
+	}
+
+	if b.file != nil {
+		// a broken log file must not stall the command
+		b.file.Write([]byte(line.Time.Format(time.RFC3339) + " " + text + "\n")) //nolint:errcheck
+	}
+
+	for sub := range b.subs {
+		select {
+		case sub <- line:
+		default:
+			// slow follower, drop the line rather than blocking ffmpeg
+		}
+	}
+}
+
+// Tail returns up to n of the most recent lines, oldest first.
+// n <= 0 returns every buffered line.
+func (b *Buffer) Tail(n int) []Line {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tail(n)
+}
+
+func (b *Buffer) tail(n int) []Line {
+	total := len(b.lines)
+	if n <= 0 || n > total {
+		n = total
+	}
+	out := make([]Line, 0, n)
+	for i := total - n; i < total; i++ {
+		out = append(out, b.lines[(b.start+i)%total])
+	}
+	return out
+}
+
+// Follow returns the last n lines and a channel receiving every line written
+// afterwards. The returned function must be called to stop following.
+func (b *Buffer) Follow(n int) ([]Line, <-chan Line, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub := make(chan Line, 256)
+	b.subs[sub] = struct{}{}
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			delete(b.subs, sub)
+			close(sub)
+		})
+	}
+	return b.tail(n), sub, stop
+}
@@ -0,0 +1,100 @@
+package streamlog
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func texts(lines []Line) string {
+	var out []string
+	for _, line := range lines {
+		out = append(out, line.Text)
+	}
+	return strings.Join(out, ",")
+}
+
+func TestBufferWrapsAround(t *testing.T) {
+	var file bytes.Buffer
+	b := NewBuffer(3, &file)
+	// lines are split across writes, \r\n endings trimmed
+	for _, chunk := range []string{"one\ntw", "o\r\nthree\n", "four\nfive\nsi", "x"} {
+		b.Write([]byte(chunk))
+	}
+
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{n: 0, want: "three,four,five"},
+		{n: 2, want: "four,five"},
+		{n: 10, want: "three,four,five"},
+	}
+	for _, tt := range tests {
+		if got := texts(b.Tail(tt.n)); got != tt.want {
+			t.Errorf("Tail(%d) = %s, want %s", tt.n, got, tt.want)
+		}
+	}
+	if tail := b.Tail(1); tail[0].Seq != 5 {
+		t.Errorf("last line #%d, want #5", tail[0].Seq)
+	}
+	// the unterminated line isn't mirrored yet
+	if got := strings.Count(file.String(), "\n"); got != 5 {
+		t.Errorf("%d lines mirrored to the file, want 5:\n%s", got, file.String())
+	}
+	if !strings.HasSuffix(file.String(), " five\n") {
+		t.Errorf("file = %q, want the lines prefixed with their time", file.String())
+	}
+}
+
+func TestBufferFollow(t *testing.T) {
+	b := NewBuffer(10, nil)
+	b.Write([]byte("before\n"))
+
+	past, lines, stop := b.Follow(5)
+	defer stop()
+	if got := texts(past); got != "before" {
+		t.Errorf("Follow() past lines = %s, want before", got)
+	}
+	b.Write([]byte("after\n"))
+	select {
+	case line := <-lines:
+		if line.Text != "after" || line.Seq != 2 {
+			t.Errorf("followed line #%d %q, want #2 after", line.Seq, line.Text)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no line followed")
+	}
+
+	stop()
+	stop()
+	if _, ok := <-lines; ok {
+		t.Error("the channel is open after stopping")
+	}
+	// writing without followers doesn't block
+	b.Write([]byte("unfollowed\n"))
+}
+
+func TestBufferSlowFollower(t *testing.T) {
+	b := NewBuffer(1000, nil)
+	_, lines, stop := b.Follow(0)
+	defer stop()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 300; i++ {
+			fmt.Fprintf(b, "line %d\n", i)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a follower which doesn't read blocks the writer")
+	}
+	if got := len(lines); got != cap(lines) {
+		t.Errorf("%d lines queued to the follower, want the %d it buffers", got, cap(lines))
+	}
+}
@@ -0,0 +1,83 @@
+package streamlog
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxBackups int
+		// want are the contents of the file and its backups, newest first
+		want []string
+	}{
+		{name: "backups", maxBackups: 2, want: []string{"eeee", "cccc\ndddd\n", "aaaa\nbbbb\n"}},
+		{name: "one backup", maxBackups: 1, want: []string{"eeee", "cccc\ndddd\n"}},
+		{name: "no backup", maxBackups: 0, want: []string{"eeee"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the directory is created
+			path := filepath.Join(t.TempDir(), "logs", "stream.log")
+			rf, err := NewRotatingFile(path, 10, tt.maxBackups)
+			if err != nil {
+				t.Fatalf("NewRotatingFile() error = %v", err)
+			}
+			for _, line := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n", "eeee"} {
+				if _, err := rf.Write([]byte(line)); err != nil {
+					t.Fatalf("Write() error = %v", err)
+				}
+			}
+			if err := rf.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			for i, want := range tt.want {
+				name := path
+				if i > 0 {
+					name = fmt.Sprintf("%s.%d", path, i)
+				}
+				data, err := os.ReadFile(name)
+				if err != nil {
+					t.Errorf("reading %s: %v", filepath.Base(name), err)
+					continue
+				}
+				if string(data) != want {
+					t.Errorf("%s = %q, want %q", filepath.Base(name), data, want)
+				}
+			}
+			extra := fmt.Sprintf("%s.%d", path, len(tt.want))
+			if _, err := os.Stat(extra); !os.IsNotExist(err) {
+				t.Errorf("%s kept beyond max_backups %d", filepath.Base(extra), tt.maxBackups)
+			}
+		})
+	}
+}
+
+func TestRotatingFileAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stream.log")
+	if err := os.WriteFile(path, []byte("12345678\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// the size of the existing file counts toward the limit
+	rf, err := NewRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatalf("NewRotatingFile() error = %v", err)
+	}
+	rf.Write([]byte("next\n"))
+	rf.Close()
+
+	if data, _ := os.ReadFile(path + ".1"); string(data) != "12345678\n" {
+		t.Errorf("backup = %q, want the existing file", data)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "next\n" {
+		t.Errorf("file = %q, want the new line", data)
+	}
+	if _, err := rf.Write([]byte("closed\n")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Write() after Close() error = %v, want os.ErrClosed", err)
+	}
+}
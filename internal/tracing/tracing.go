@@ -0,0 +1,94 @@
+// Package tracing sets up OpenTelemetry tracing of the proxy.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/meanii/hlsproxy/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	instrumentationName = "github.com/meanii/hlsproxy"
+	defaultServiceName  = "hlsproxy"
+)
+
+// StreamID is the attribute carrying the stream a span belongs to.
+func StreamID(id string) attribute.KeyValue {
+	return attribute.String("hlsproxy.stream.id", id)
+}
+
+// Setup installs the tracer provider configured in config.yaml and returns
+// the function flushing and stopping it. Tracing is a no-op when disabled.
+func Setup(ctx context.Context) (func(context.Context) error, error) {
+	cfg := config.GetConfig("").Config.Tracing
+	if !cfg.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	switch cfg.Exporter {
+	case "", "otlp":
+		opts := []otlptracehttp.Option{}
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		if len(cfg.Headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(cfg.Headers))
+		}
+		otlp, err := otlptracehttp.New(ctx, opts...)
+		if err != nil {
+			return nil, err
+		}
+		exporter = otlp
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", cfg.Exporter)
+	}
+
+	zap.S().Info("tracing: exporting spans with the otlp exporter")
+	return install(sdktrace.WithBatcher(exporter), cfg.ServiceName, cfg.SampleRatio), nil
+}
+
+// SetExporter installs a tracer provider sending every span to exporter
+// as soon as it ends, for tests to record the spans.
+func SetExporter(exporter sdktrace.SpanExporter) func(context.Context) error {
+	return install(sdktrace.WithSyncer(exporter), "", 1)
+}
+
+// install sets the global tracer provider, sampling ratio of the root spans.
+func install(export sdktrace.TracerProviderOption, serviceName string, ratio float64) func(context.Context) error {
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+	if ratio <= 0 || ratio > 1 {
+		ratio = 1
+	}
+	res, _ := resource.Merge(resource.Default(),
+		resource.NewSchemaless(attribute.String("service.name", serviceName)))
+
+	provider := sdktrace.NewTracerProvider(
+		export,
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown
+}
+
+// Tracer returns the tracer of the proxy.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
@@ -0,0 +1,364 @@
+package transcoder
+
+import (
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/meanii/hlsproxy/config"
+)
+
+// x264 holds the libx264 options of each varient.
+var x264 = map[string]string{
+	"240p":  "-c:v libx264 -preset veryfast -profile:v main -level:v 3.0 -a53cc 1 -b:v 500k -maxrate 500k -bufsize 1000k",
+	"360p":  "-c:v libx264 -preset veryfast -profile:v main -level:v 3.0 -a53cc 1 -b:v 1200k -maxrate 1200k -bufsize 2400k",
+	"480p":  "-c:v libx264 -preset veryfast -profile:v main -level:v 3.1 -a53cc 1 -b:v 3000k -maxrate 3000k -bufsize 6000k",
+	"720p":  "-c:v libx264 -preset veryfast -profile:v high -level:v 3.1 -a53cc 1 -b:v 5000k -maxrate 5000k -bufsize 10000k",
+	"1080p": "-c:v libx264 -preset veryfast -profile:v high -level:v 4.0 -a53cc 1 -b:v 7000k -maxrate 7000k -bufsize 14000k",
+}
+
+// gop is the keyframe placement of every rendition, the frame rate being unknown.
+const gop = "-g 60 -keyint_min 60 -sc_threshold 0 -force_key_frames expr:gte(t,n_forced*2)"
+
+const head = "ffmpeg -loglevel repeat+level+verbose -progress pipe:1 -nostats"
+
+// hlsOutput returns the hls muxer options and playlist of a rendition under /out.
+func hlsOutput(rendition string, startNumber int, segmentType string) string {
+	flags := "delete_segments+split_by_time"
+	if startNumber > 0 {
+		flags += "+discont_start"
+	}
+	out := "-start_number " + strconv.Itoa(startNumber) + " -hls_time 2 -hls_list_size 10 -hls_flags " + flags +
+		" -hls_segment_type " + segmentType + " -hls_segment_filename /out/" + rendition + "/%03d" + segmentExtension(segmentType)
+	if segmentType == "fmp4" {
+		out += " -hls_fmp4_init_filename init.mp4"
+	}
+	return out + " -f hls /out/" + rendition + "/" + rendition + ".m3u8"
+}
+
+// fields splits a command line on spaces, none of the arguments built by
+// the tests holds one except for the sources, which are kept apart.
+func fields(parts ...string) []string {
+	var args []string
+	for _, part := range parts {
+		args = append(args, strings.Fields(part)...)
+	}
+	return args
+}
+
+// argsOf returns the values following every occurrence of flag.
+func argsOf(argv []string, flag string) []string {
+	var values []string
+	for i := 0; i+1 < len(argv); i++ {
+		if argv[i] == flag {
+			values = append(values, argv[i+1])
+		}
+	}
+	return values
+}
+
+func TestGenerateArgs(t *testing.T) {
+	const source = "rtmp://example.com/live/stream"
+	const oddSource = `rtmp://example.com/live/$HOME "quoted" 'single' with spaces`
+
+	tests := []struct {
+		name        string
+		source      string
+		varients    []string
+		audio       bool
+		videoCodec  string
+		subtitles   []SubtitleTrack
+		nextSegment int
+
+		filter       string
+		maps         []string
+		startNumbers []string
+		want         []string
+	}{
+		{
+			name:         "1 rung h264 muxed audio",
+			source:       source,
+			varients:     []string{"720p"},
+			videoCodec:   "h264",
+			filter:       "[0:v]split=1[v0];[v0]scale=w=1280:h=720[v0out]",
+			maps:         []string{"[v0out]", "0:a?"},
+			startNumbers: []string{"0"},
+			want: fields(head, "-i", source,
+				"-filter_complex [0:v]split=1[v0];[v0]scale=w=1280:h=720[v0out]",
+				"-map [v0out] -map 0:a? -c:a aac -b:a 128k", x264["720p"], gop, hlsOutput("720p", 0, "mpegts")),
+		},
+		{
+			name:         "3 rungs h264 muxed audio",
+			source:       source,
+			varients:     []string{"360p", "720p", "1080p"},
+			videoCodec:   "h264",
+			filter:       "[0:v]split=3[v0][v1][v2];[v0]scale=w=640:h=360[v0out];[v1]scale=w=1280:h=720[v1out];[v2]scale=w=1920:h=1080[v2out]",
+			maps:         []string{"[v0out]", "0:a?", "[v1out]", "0:a?", "[v2out]", "0:a?"},
+			startNumbers: []string{"0", "0", "0"},
+			want: fields(head, "-i", source,
+				"-filter_complex [0:v]split=3[v0][v1][v2];[v0]scale=w=640:h=360[v0out];[v1]scale=w=1280:h=720[v1out];[v2]scale=w=1920:h=1080[v2out]",
+				"-map [v0out] -map 0:a? -c:a aac -b:a 128k", x264["360p"], gop, hlsOutput("360p", 0, "mpegts"),
+				"-map [v1out] -map 0:a? -c:a aac -b:a 128k", x264["720p"], gop, hlsOutput("720p", 0, "mpegts"),
+				"-map [v2out] -map 0:a? -c:a aac -b:a 128k", x264["1080p"], gop, hlsOutput("1080p", 0, "mpegts")),
+		},
+		{
+			name:       "5 rungs h264 separate audio",
+			source:     source,
+			varients:   []string{"240p", "360p", "480p", "720p", "1080p"},
+			audio:      true,
+			videoCodec: "h264",
+			filter: "[0:v]split=5[v0][v1][v2][v3][v4];[v0]scale=w=426:h=240[v0out];[v1]scale=w=640:h=360[v1out];" +
+				"[v2]scale=w=854:h=480[v2out];[v3]scale=w=1280:h=720[v3out];[v4]scale=w=1920:h=1080[v4out]",
+			maps:         []string{"[v0out]", "[v1out]", "[v2out]", "[v3out]", "[v4out]", "0:a:0"},
+			startNumbers: []string{"0", "0", "0", "0", "0", "0"},
+			want: fields(head, "-i", source,
+				"-filter_complex [0:v]split=5[v0][v1][v2][v3][v4];[v0]scale=w=426:h=240[v0out];[v1]scale=w=640:h=360[v1out];"+
+					"[v2]scale=w=854:h=480[v2out];[v3]scale=w=1280:h=720[v3out];[v4]scale=w=1920:h=1080[v4out]",
+				"-map [v0out]", x264["240p"], gop, hlsOutput("240p", 0, "mpegts"),
+				"-map [v1out]", x264["360p"], gop, hlsOutput("360p", 0, "mpegts"),
+				"-map [v2out]", x264["480p"], gop, hlsOutput("480p", 0, "mpegts"),
+				"-map [v3out]", x264["720p"], gop, hlsOutput("720p", 0, "mpegts"),
+				"-map [v4out]", x264["1080p"], gop, hlsOutput("1080p", 0, "mpegts"),
+				"-map 0:a:0 -c:a aac -b:a 128k", hlsOutput("audio_aac_0", 0, "mpegts")),
+		},
+		{
+			name:         "hevc separate audio",
+			source:       source,
+			varients:     []string{"720p"},
+			audio:        true,
+			videoCodec:   "hevc",
+			filter:       "[0:v]split=1[v0];[v0]scale=w=1280:h=720[v0out]",
+			maps:         []string{"[v0out]", "0:a:0"},
+			startNumbers: []string{"0", "0"},
+			want: fields(head, "-i", source,
+				"-filter_complex [0:v]split=1[v0];[v0]scale=w=1280:h=720[v0out]",
+				"-map [v0out] -c:v libx265 -preset veryfast -profile:v main -a53cc 1 -x265-params level-idc=3.1 -tag:v hvc1",
+				"-b:v 5000k -maxrate 5000k -bufsize 10000k", gop, hlsOutput("720p", 0, "fmp4"),
+				"-map 0:a:0 -c:a aac -b:a 128k", hlsOutput("audio_aac_0", 0, "fmp4")),
+		},
+		{
+			name:         "av1 muxed audio",
+			source:       source,
+			varients:     []string{"720p"},
+			videoCodec:   "av1",
+			filter:       "[0:v]split=1[v0];[v0]scale=w=1280:h=720[v0out]",
+			maps:         []string{"[v0out]", "0:a?"},
+			startNumbers: []string{"0"},
+			want: fields(head, "-i", source,
+				"-filter_complex [0:v]split=1[v0];[v0]scale=w=1280:h=720[v0out]",
+				"-map [v0out] -map 0:a? -c:a aac -b:a 128k -c:v libsvtav1 -preset 10 -level:v 31 -tag:v av01",
+				"-b:v 5000k -maxrate 5000k -bufsize 10000k", gop, hlsOutput("720p", 0, "fmp4")),
+		},
+		{
+			name:         "vp9 muxed audio",
+			source:       source,
+			varients:     []string{"720p"},
+			videoCodec:   "vp9",
+			filter:       "[0:v]split=1[v0];[v0]scale=w=1280:h=720[v0out]",
+			maps:         []string{"[v0out]", "0:a?"},
+			startNumbers: []string{"0"},
+			want: fields(head, "-i", source,
+				"-filter_complex [0:v]split=1[v0];[v0]scale=w=1280:h=720[v0out]",
+				"-map [v0out] -map 0:a? -c:a aac -b:a 128k -c:v libvpx-vp9 -profile:v 0 -level:v 3.1 -deadline realtime -cpu-used 8 -row-mt 1 -tag:v vp09",
+				"-b:v 5000k -maxrate 5000k -bufsize 10000k", gop, hlsOutput("720p", 0, "fmp4")),
+		},
+		{
+			name:         "subtitles resuming numbering",
+			source:       source,
+			varients:     []string{"360p"},
+			audio:        true,
+			videoCodec:   "h264",
+			subtitles:    []SubtitleTrack{{Index: 1, Language: "en"}},
+			nextSegment:  42,
+			filter:       "[0:v]split=1[v0];[v0]scale=w=640:h=360[v0out]",
+			maps:         []string{"[v0out]", "0:a:0", "0:s:1"},
+			startNumbers: []string{"42", "42", "42"},
+			want: fields(head, "-i", source,
+				"-filter_complex [0:v]split=1[v0];[v0]scale=w=640:h=360[v0out]",
+				"-map [v0out]", x264["360p"], gop, hlsOutput("360p", 42, "mpegts"),
+				"-map 0:a:0 -c:a aac -b:a 128k", hlsOutput("audio_aac_0", 42, "mpegts"),
+				"-map 0:s:1 -c:s webvtt -f segment -segment_start_number 42 -segment_time 2 -segment_format webvtt",
+				"-segment_list /out/subs_0/subs_0.m3u8 -segment_list_type m3u8 -segment_list_size 10 -segment_list_flags +live /out/subs_0/%03d.vtt"),
+		},
+		{
+			name:         "source with shell characters",
+			source:       oddSource,
+			varients:     []string{"360p"},
+			videoCodec:   "h264",
+			filter:       "[0:v]split=1[v0];[v0]scale=w=640:h=360[v0out]",
+			maps:         []string{"[v0out]", "0:a?"},
+			startNumbers: []string{"0"},
+			want: append(append(fields(head, "-i"), oddSource), fields(
+				"-filter_complex [0:v]split=1[v0];[v0]scale=w=640:h=360[v0out]",
+				"-map [v0out] -map 0:a? -c:a aac -b:a 128k", x264["360p"], gop, hlsOutput("360p", 0, "mpegts"))...),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tsc := NewTranscoder(tt.source, "test")
+			tsc.SetConfig(tt.varients, tt.audio, tt.videoCodec, "aac")
+			tsc.SetSubtitleTracks(tt.subtitles)
+			tsc.OutputDir = "/out"
+			tsc.nextSegment = tt.nextSegment
+
+			argv, err := tsc.generateArgs()
+			if err != nil {
+				t.Fatalf("generateArgs() error = %v", err)
+			}
+
+			if got := argsOf(argv, "-filter_complex"); len(got) != 1 || got[0] != tt.filter {
+				t.Errorf("filter graph = %q, want %q", got, tt.filter)
+			}
+			if got := argsOf(argv, "-map"); !reflect.DeepEqual(got, tt.maps) {
+				t.Errorf("maps = %q, want %q", got, tt.maps)
+			}
+			startNumbers := append(argsOf(argv, "-start_number"), argsOf(argv, "-segment_start_number")...)
+			if !reflect.DeepEqual(startNumbers, tt.startNumbers) {
+				t.Errorf("start numbers = %q, want %q", startNumbers, tt.startNumbers)
+			}
+			if got := argsOf(argv, "-i"); len(got) != 1 || got[0] != tt.source {
+				t.Errorf("inputs = %q, want [%q]", got, tt.source)
+			}
+			if !reflect.DeepEqual(argv, tt.want) {
+				t.Errorf("argv =\n%q\nwant\n%q", argv, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateArgsIngest(t *testing.T) {
+	output := &config.GetConfig("").Config.Output
+	output.Ingest.URL = "http://127.0.0.1:8001/ingest/"
+	tests := []struct {
+		name        string
+		ingest      bool
+		storageType string
+	}{
+		{name: "ingest enabled", ingest: true, storageType: "local"},
+		// segments in memory never touch the disk
+		{name: "memory storage", ingest: false, storageType: "memory"},
+	}
+	defer func(storageType string) {
+		output.Ingest.Enabled, output.Storage.Type = false, storageType
+	}(output.Storage.Type)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output.Ingest.Enabled, output.Storage.Type = tt.ingest, tt.storageType
+
+			tsc := NewTranscoder("rtmp://example.com/live/stream", "test")
+			tsc.SetConfig([]string{"360p"}, false, "h264", "aac")
+			tsc.SetSubtitleTracks([]SubtitleTrack{{Index: 0}})
+			tsc.OutputDir = "/out"
+
+			argv, err := tsc.generateArgs()
+			if err != nil {
+				t.Fatalf("generateArgs() error = %v", err)
+			}
+			const base = "http://127.0.0.1:8001/ingest/test/"
+			for _, want := range []string{
+				base + "360p/360p.m3u8",
+				base + "subs_0/subs_0.m3u8",
+				base + "subs_0/%03d.vtt",
+			} {
+				if !slices.Contains(argv, want) {
+					t.Errorf("argv doesn't write to %s: %q", want, argv)
+				}
+			}
+			for _, arg := range argv {
+				if strings.HasPrefix(arg, "/out") {
+					t.Errorf("argv writes %s to disk", arg)
+				}
+			}
+		})
+	}
+}
+
+func TestCountAudioStreams(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    int
+		wantErr bool
+	}{
+		{
+			name: "audio and video",
+			out: "Input #0, flv, from 'rtmp://example.com/live/stream':\n" +
+				"  Stream #0:0: Video: h264 (High), yuv420p(progressive), 1280x720, 30 fps\n" +
+				"  Stream #0:1: Audio: aac (LC), 48000 Hz, stereo, fltp, 128 kb/s\n" +
+				"At least one output file must be specified\n",
+			want: 1,
+		},
+		{
+			name: "video only",
+			out: "Input #0, mpegts, from 'srt://example.com:9000':\n" +
+				"  Stream #0:0[0x100]: Video: h264 (Main) ([27][0][0][0] / 0x001B), yuv420p, 1920x1080\n" +
+				"At least one output file must be specified\n",
+			want: 0,
+		},
+		{
+			name: "two languages",
+			out: "Input #0, hls, from 'https://example.com/live.m3u8':\n" +
+				"  Stream #0:0: Video: h264, yuv420p, 1280x720\n" +
+				"  Stream #0:1(eng): Audio: aac, 48000 Hz, stereo\n" +
+				"  Stream #0:2(fra): Audio: aac, 48000 Hz, stereo\n",
+			want: 2,
+		},
+		{
+			name:    "unreachable",
+			out:     "rtmp://example.com/live/stream: Connection refused\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		got, err := countAudioStreams(tt.out)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: countAudioStreams() = %d, %v, want %d, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestSilenceDetectorNeedsSourceAudio(t *testing.T) {
+	watchdog := &config.GetConfig("").Config.Ffmpeg.Watchdog
+	watchdog.Detect = []string{"silence"}
+	defer func() { watchdog.Detect = nil }()
+
+	for _, streams := range []int{0, 1} {
+		tsc := NewTranscoder("rtmp://example.com/live/stream", "test")
+		tsc.SetConfig([]string{"360p", "audio"}, true, "h264", "aac")
+		// probed already
+		tsc.audioStreams[tsc.Source] = streams
+
+		argv, err := tsc.generateArgs()
+		if err != nil {
+			t.Fatalf("generateArgs() error = %v", err)
+		}
+		got := strings.Contains(strings.Join(argv, " "), "silencedetect")
+		if want := streams > 0; got != want {
+			t.Errorf("source with %d audio streams: silencedetect in argv = %v, want %v", streams, got, want)
+		}
+	}
+}
+
+func TestGenerateArgsSlateKeepsAspectRatio(t *testing.T) {
+	tsc := NewTranscoder("rtmp://example.com/live/stream", "test")
+	tsc.SetConfig([]string{"360p", "720p"}, false, "h264", "aac")
+	tsc.SetSlate("/slates/offline.png")
+	// every source failed, the stream shows its slate
+	tsc.source = len(tsc.sources())
+
+	argv, err := tsc.generateArgs()
+	if err != nil {
+		t.Fatalf("generateArgs() error = %v", err)
+	}
+	filter := argv[slices.Index(argv, "-filter_complex")+1]
+	want := "[0:v]split=2[v0][v1];" +
+		"[v0]scale=w=640:h=360:force_original_aspect_ratio=decrease:force_divisible_by=2,pad=w=640:h=360:x=(ow-iw)/2:y=(oh-ih)/2,setsar=1[v0out];" +
+		"[v1]scale=w=1280:h=720:force_original_aspect_ratio=decrease:force_divisible_by=2,pad=w=1280:h=720:x=(ow-iw)/2:y=(oh-ih)/2,setsar=1[v1out]"
+	if filter != want {
+		t.Errorf("filter graph =\n%s\nwant\n%s", filter, want)
+	}
+}
@@ -0,0 +1,264 @@
+package transcoder
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/grafov/m3u8"
+	"go.uber.org/zap"
+)
+
+const (
+	describesVideo = "public.accessibility.describes-video"
+
+	// EBU R128 defaults of the loudnorm filter.
+	defaultIntegratedLoudness = -23
+	defaultTruePeak           = -1
+	defaultLoudnessRange      = 7
+)
+
+// AudioTrack is an audio rendition mapped from a source audio stream.
+type AudioTrack struct {
+	// Index is the index of the source audio stream, as in -map 0:a:<Index>.
+	Index    int    `json:"index"`
+	Language string `json:"language"`
+	Name     string `json:"name"`
+	Default  bool   `json:"default"`
+	// Descriptive marks an audio description track for the visually impaired.
+	Descriptive bool `json:"descriptive"`
+}
+
+// Loudnorm configures EBU R128 loudness normalization. Zero values
+// fall back to the R128 broadcast targets.
+type Loudnorm struct {
+	Enabled bool `json:"enabled"`
+	// Integrated is the target integrated loudness in LUFS.
+	Integrated float64 `json:"integrated"`
+	// TruePeak is the maximum true peak in dBTP.
+	TruePeak float64 `json:"true_peak"`
+	// LRA is the target loudness range in LU.
+	LRA float64 `json:"lra"`
+}
+
+// AudioOptions holds the processing applied to every audio rendition.
+type AudioOptions struct {
+	Loudnorm Loudnorm `json:"loudnorm"`
+	// Channels down-mixes the audio to this many channels, 0 keeps the source layout.
+	Channels int `json:"channels"`
+}
+
+// ParseAudioCodec parses the audio codec names accepted in the config and API.
+func ParseAudioCodec(name string) (AudioCodecType, bool) {
+	switch strings.ToLower(name) {
+	case "aac":
+		return AAC, true
+	case "eac3", "e-ac-3", "ec-3":
+		return EAC3, true
+	case "ac3", "ac-3":
+		return AC3, true
+	case "opus":
+		return Opus, true
+	}
+	return AAC, false
+}
+
+// encoder returns the ffmpeg encoder of the audio codec.
+func (ac AudioCodecType) encoder() string {
+	switch ac {
+	case EAC3:
+		return "eac3"
+	case AC3:
+		return "ac3"
+	case Opus:
+		return "libopus"
+	}
+	return "aac"
+}
+
+// bitrate returns the bitrate audio is encoded at, in kbps.
+func (ac AudioCodecType) bitrate() int {
+	switch ac {
+	case EAC3:
+		return 256
+	case AC3:
+		return 384
+	case Opus:
+		return 96
+	}
+	return 128
+}
+
+// SetAudioTracks replaces the audio renditions of the stream. Tracks are
+// only produced when audio is enabled.
+func (t *Transcoder) SetAudioTracks(tracks []AudioTrack) {
+	if len(tracks) == 0 {
+		return
+	}
+	t.AudioTracks = tracks
+}
+
+// SetAudioCodecs sets the codecs every audio track is encoded with, each
+// published as its own EXT-X-MEDIA group. Unknown names are skipped.
+func (t *Transcoder) SetAudioCodecs(names []string) {
+	audioCodecs := make([]AudioCodecType, 0, len(names))
+	for _, name := range names {
+		codec, ok := ParseAudioCodec(name)
+		if !ok {
+			zap.S().Warnf("transcoder: skipping unknown audio codec %s", name)
+			continue
+		}
+		audioCodecs = append(audioCodecs, codec)
+	}
+	if len(audioCodecs) > 0 {
+		t.AudioCodecs = audioCodecs
+	}
+}
+
+// SetAudioOptions sets loudness normalization and down-mixing.
+func (t *Transcoder) SetAudioOptions(options AudioOptions) {
+	t.AudioOptions = options
+}
+
+// audioEnabled reports whether the stream has demuxed audio renditions.
+func (t *Transcoder) audioEnabled() bool {
+	return t.hasVarient("audio")
+}
+
+// audioTracks returns the audio renditions to produce, defaulting to
+// the first source audio stream.
+func (t *Transcoder) audioTracks() []AudioTrack {
+	if !t.audioEnabled() {
+		return nil
+	}
+	if len(t.AudioTracks) == 0 {
+		return []AudioTrack{{Index: 0, Name: "default", Default: true}}
+	}
+	return t.AudioTracks
+}
+
+// audioCodecs returns the codecs audio renditions are encoded with,
+// defaulting to the stream's audio codec.
+func (t *Transcoder) audioCodecs() []AudioCodecType {
+	if !t.audioEnabled() {
+		return nil
+	}
+	if len(t.AudioCodecs) == 0 {
+		return []AudioCodecType{t.AudioCodec}
+	}
+	return t.AudioCodecs
+}
+
+// audioGroupID returns the EXT-X-MEDIA group of the codec's renditions.
+func audioGroupID(codec AudioCodecType) string {
+	return "audio-" + strings.ToLower(codec.String())
+}
+
+// audioRendition returns the output directory name of the i-th audio track
+// encoded with codec.
+func audioRendition(codec AudioCodecType, i int) string {
+	return "audio_" + strings.ToLower(codec.String()) + "_" + strconv.Itoa(i)
+}
+
+// audioSegmentType returns the segment container of an audio rendition.
+// Opus can only be carried in fragmented mp4.
+func (t *Transcoder) audioSegmentType(codec AudioCodecType) string {
+	if codec == Opus {
+		return "fmp4"
+	}
+	return t.VideoCodec.SegmentType()
+}
+
+// audioAlternatives returns the EXT-X-MEDIA entries of the codec's audio
+// group, with URIs prefixed by uriPrefix.
+func (t *Transcoder) audioAlternatives(codec AudioCodecType, uriPrefix string) []*m3u8.Alternative {
+	tracks := t.audioTracks()
+
+	hasDefault := false
+	for _, track := range tracks {
+		hasDefault = hasDefault || track.Default
+	}
+
+	alternatives := make([]*m3u8.Alternative, 0, len(tracks))
+	for i, track := range tracks {
+		rendition := audioRendition(codec, i)
+		name := track.Name
+		if name == "" {
+			name = fmt.Sprintf("audio %d", i+1)
+			if track.Language != "" {
+				name = track.Language
+			}
+		}
+
+		alternative := &m3u8.Alternative{
+			Type:       "AUDIO",
+			GroupId:    audioGroupID(codec),
+			Name:       name,
+			Language:   track.Language,
+			Default:    track.Default || (!hasDefault && i == 0),
+			Autoselect: "YES",
+			URI:        fmt.Sprintf("%s%s/%s.m3u8", uriPrefix, rendition, rendition),
+		}
+		if track.Descriptive {
+			alternative.Characteristics = describesVideo
+			alternative.Default = false
+		}
+		alternatives = append(alternatives, alternative)
+	}
+	return alternatives
+}
+
+// defaultAlternative returns the rendition players pick by default.
+func defaultAlternative(alternatives []*m3u8.Alternative) *m3u8.Alternative {
+	for _, alternative := range alternatives {
+		if alternative.Default {
+			return alternative
+		}
+	}
+	return alternatives[0]
+}
+
+// audioEncoderOptions returns the encoder and filter options of codec.
+func (t *Transcoder) audioEncoderOptions(codec AudioCodecType) []string {
+	options := []string{"-c:a", codec.encoder(), "-b:a", strconv.Itoa(codec.bitrate()) + "k"}
+	if filter := t.audioFilter(); filter != "" {
+		options = append(options, "-af", filter)
+	}
+	if t.AudioOptions.Channels > 0 {
+		options = append(options, "-ac", strconv.Itoa(t.AudioOptions.Channels))
+	}
+	return options
+}
+
+// audioFilter returns the -af filter chain, empty if none is needed.
+func (t *Transcoder) audioFilter() string {
+	loudnorm := t.AudioOptions.Loudnorm
+	if !loudnorm.Enabled {
+		return ""
+	}
+	integrated := loudnorm.Integrated
+	if integrated == 0 {
+		integrated = defaultIntegratedLoudness
+	}
+	truePeak := loudnorm.TruePeak
+	if truePeak == 0 {
+		truePeak = defaultTruePeak
+	}
+	lra := loudnorm.LRA
+	if lra == 0 {
+		lra = defaultLoudnessRange
+	}
+	// loudnorm upsamples to 192kHz, which AC-3 and E-AC-3 can't encode
+	return fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%g,aresample=48000", integrated, truePeak, lra)
+}
+
+// audioOutputOptions returns the ffmpeg output options of the i-th audio
+// track encoded with codec.
+func (t *Transcoder) audioOutputOptions(codec AudioCodecType, i int, track AudioTrack) []string {
+	options := []string{"-map", t.audioMap(track)}
+	options = append(options, t.audioEncoderOptions(codec)...)
+	if track.Language != "" {
+		options = append(options, "-metadata:s:a:0", "language="+track.Language)
+	}
+	return append(options, t.hlsOptions(audioRendition(codec, i), t.audioSegmentType(codec))...)
+}
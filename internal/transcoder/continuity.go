@@ -0,0 +1,251 @@
+package transcoder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/meanii/hlsproxy/internal/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	discontinuityTag         = "#EXT-X-DISCONTINUITY"
+	discontinuitySequenceTag = "#EXT-X-DISCONTINUITY-SEQUENCE:"
+	mediaSequenceTag         = "#EXT-X-MEDIA-SEQUENCE:"
+)
+
+// segmentNumber returns the sequence number in the name of a segment.
+func segmentNumber(name string) (int, bool) {
+	base := path.Base(name)
+	base = strings.TrimSuffix(base, path.Ext(base))
+	n, err := strconv.Atoi(base)
+	return n, err == nil
+}
+
+// resumeNumbering makes the next ffmpeg run number its segments after
+// every segment written so far, listed or not, and records the
+// discontinuity at its first segment.
+func (t *Transcoder) resumeNumbering() {
+	next := lastSegmentOnDisk(t.OutputDir) + 1
+
+	t.Mux.Lock()
+	defer t.Mux.Unlock()
+	if next < t.nextSegment {
+		next = t.nextSegment
+	}
+	if next == 0 {
+		// nothing was written, the restart starts the stream over
+		return
+	}
+	t.nextSegment = next
+	if n := len(t.discontinuities); n == 0 || t.discontinuities[n-1] != next {
+		t.discontinuities = append(t.discontinuities, next)
+	}
+}
+
+// lastSegmentOnDisk returns the highest segment number under dir, -1 when
+// there is none.
+func lastSegmentOnDisk(dir string) int {
+	last := -1
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		switch filepath.Ext(p) {
+		case ".ts", ".m4s", ".vtt":
+			if n, ok := segmentNumber(p); ok && n > last {
+				last = n
+			}
+		}
+		return nil
+	})
+	return last
+}
+
+// dropped returns a function reporting whether a segment of a rendition
+// slid out of its playlist and nothing else deletes it: the hls muxer only
+// deletes the segments of its own run, the segment muxer of the subtitles
+// none. Segments newer than the playlist are still being written.
+func (t *Transcoder) dropped(playlist []byte) func(name string) bool {
+	t.Mux.RLock()
+	start := 0
+	if n := len(t.discontinuities); n > 0 {
+		start = t.discontinuities[n-1]
+	}
+	t.Mux.RUnlock()
+
+	listed := make(map[string]bool)
+	first := -1
+	for _, segment := range playlistSegments(playlist) {
+		listed[path.Base(segment)] = true
+		if n, ok := segmentNumber(segment); ok && (first < 0 || n < first) {
+			first = n
+		}
+	}
+	return func(name string) bool {
+		n, ok := segmentNumber(name)
+		if !ok || listed[path.Base(name)] {
+			return false
+		}
+		return n < start || path.Ext(name) == ".vtt" && n < first
+	}
+}
+
+// pruneDisk deletes the dropped segments from the directory of a rendition.
+func (t *Transcoder) pruneDisk(rendition string, playlist []byte) {
+	stale := t.dropped(playlist)
+	entries, err := os.ReadDir(filepath.Join(t.OutputDir, rendition))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !stale(entry.Name()) {
+			continue
+		}
+		switch filepath.Ext(entry.Name()) {
+		case ".ts", ".m4s", ".vtt":
+			p := filepath.Join(t.OutputDir, rendition, entry.Name())
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				zap.S().Warnf("transcoder: failed to remove %s, Error: %s", p, err)
+			}
+		}
+	}
+}
+
+// pruneIngested deletes the dropped segments ffmpeg uploaded for a rendition.
+func (t *Transcoder) pruneIngested(ctx context.Context, rendition string, playlist []byte) {
+	stale := t.dropped(playlist)
+	prefix := t.ID + "/" + rendition + "/"
+	var keys []string
+	t.Mux.RLock()
+	for key := range t.ingested {
+		if strings.HasPrefix(key, prefix) && path.Ext(key) != ".m3u8" && stale(key) {
+			keys = append(keys, key)
+		}
+	}
+	t.Mux.RUnlock()
+
+	for _, key := range keys {
+		if err := t.IngestDelete(ctx, strings.TrimPrefix(key, t.ID+"/")); err != nil {
+			zap.S().Warnf("transcoder: failed to delete %s, Error: %s", key, err)
+		}
+	}
+}
+
+// continuePlaylist marks the restarts of ffmpeg in a media playlist: a
+// discontinuity before the first segment of each run and the discontinuity
+// sequence of the first segment listed. The tags ffmpeg wrote are replaced.
+func (t *Transcoder) continuePlaylist(_ string, data []byte) []byte {
+	t.Mux.RLock()
+	discontinuities := make(map[int]bool, len(t.discontinuities))
+	for _, n := range t.discontinuities {
+		discontinuities[n] = true
+	}
+	points := append([]int(nil), t.discontinuities...)
+	t.Mux.RUnlock()
+	if len(points) == 0 {
+		return data
+	}
+
+	lines := strings.Split(string(data), "\n")
+	out := make([]string, 0, len(lines)+len(points)+1)
+	// tags of the segment being read, its EXTINF at inf
+	var pending []string
+	inf := -1
+	first := -1
+	for _, line := range lines {
+		text := strings.TrimRight(line, "\r")
+		switch {
+		case text == discontinuityTag || strings.HasPrefix(text, discontinuitySequenceTag):
+		case strings.HasPrefix(text, "#EXTINF:"):
+			inf = len(pending)
+			pending = append(pending, text)
+		case text == "" || strings.HasPrefix(text, "#"):
+			pending = append(pending, text)
+		default:
+			n, ok := segmentNumber(text)
+			if ok && first < 0 {
+				first = n
+			}
+			if ok && discontinuities[n] && inf >= 0 {
+				pending = append(pending[:inf], append([]string{discontinuityTag}, pending[inf:]...)...)
+			}
+			out = append(out, pending...)
+			out = append(out, text)
+			pending = pending[:0]
+			inf = -1
+		}
+	}
+	out = append(out, pending...)
+	if first < 0 {
+		// a master playlist or no segment yet
+		return data
+	}
+
+	// the discontinuities before the first segment slid out of the playlist
+	sequence := 0
+	for _, n := range points {
+		if n < first {
+			sequence++
+		}
+	}
+	for i, text := range out {
+		if strings.HasPrefix(text, mediaSequenceTag) {
+			out = append(out[:i+1], append([]string{fmt.Sprintf("%s%d", discontinuitySequenceTag, sequence)}, out[i+1:]...)...)
+			break
+		}
+	}
+	return []byte(strings.Join(out, "\n"))
+}
+
+// filterObject edits the text objects of the stream before they are
+// served or stored: restarts are marked in the media playlists and the
+// WebVTT segments get their timestamp map.
+func (t *Transcoder) filterObject(name string, data []byte) []byte {
+	switch path.Ext(name) {
+	case ".m3u8":
+		return t.continuePlaylist(name, data)
+	case ".vtt":
+		return t.addTimestampMap(data)
+	}
+	return data
+}
+
+// PlaylistHandler serves the output directory of the streams with
+// next, marking the restarts of ffmpeg in the media playlists of the
+// running streams and mapping the timestamps of their WebVTT segments.
+func PlaylistHandler(root string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+		id, _, _ := strings.Cut(name, "/")
+		t, ok := Lookup(id)
+		if !ok || path.Ext(name) != ".m3u8" && path.Ext(name) != ".vtt" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		file := filepath.Join(root, filepath.FromSlash(name))
+		info, err := os.Stat(file)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		data = t.filterObject(name, data)
+		w.Header().Set("Content-Type", storage.ContentType(name))
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeContent(w, r, name, info.ModTime(), bytes.NewReader(data))
+	})
+}
@@ -0,0 +1,144 @@
+package transcoder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// restartedPlaylist lists the first segments of the run started at 003.ts,
+// along with 002.ts which the previous run still shares with players.
+const restartedPlaylist = "#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:2\n#EXTINF:2.000000,\n002.ts\n#EXT-X-DISCONTINUITY\n#EXTINF:2.000000,\n003.ts\n#EXTINF:2.000000,\n004.ts\n"
+
+func restartedTranscoder() *Transcoder {
+	tsc := NewTranscoder("rtmp://example.com/live/stream", "test")
+	tsc.SetConfig([]string{"360p"}, false, "h264", "aac")
+	tsc.discontinuities = []int{3}
+	tsc.nextSegment = 5
+	return tsc
+}
+
+func TestPruneDisk(t *testing.T) {
+	tsc := restartedTranscoder()
+	tsc.OutputDir = t.TempDir()
+	dir := filepath.Join(tsc.OutputDir, "360p")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"000.ts", "001.ts", "002.ts", "003.ts", "004.ts", "360p.m3u8"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tsc.pruneDisk("360p", []byte(restartedPlaylist))
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.Name())
+	}
+	if want := "002.ts,003.ts,004.ts,360p.m3u8"; strings.Join(got, ",") != want {
+		t.Errorf("files left = %v, want %s", got, want)
+	}
+}
+
+func TestPruneIngested(t *testing.T) {
+	tsc := restartedTranscoder()
+	store := &mapStore{objects: make(map[string]string)}
+	tsc.storage = store
+	ctx := context.Background()
+	for _, name := range []string{"360p/000.ts", "360p/001.ts", "360p/002.ts", "360p/003.ts", "360p/004.ts", "audio_aac_1/001.ts"} {
+		if err := tsc.Ingest(ctx, name, strings.NewReader("segment"), 7); err != nil {
+			t.Fatalf("Ingest(%s) error = %v", name, err)
+		}
+	}
+	if err := tsc.Ingest(ctx, "360p/360p.m3u8", strings.NewReader(restartedPlaylist), int64(len(restartedPlaylist))); err != nil {
+		t.Fatalf("Ingest() of the playlist error = %v", err)
+	}
+
+	var got []string
+	for key := range store.objects {
+		got = append(got, key)
+	}
+	sort.Strings(got)
+	// other renditions are pruned by their own playlist
+	want := "test/360p/002.ts,test/360p/003.ts,test/360p/004.ts,test/360p/360p.m3u8,test/audio_aac_1/001.ts"
+	if strings.Join(got, ",") != want {
+		t.Errorf("objects left = %v, want %s", got, want)
+	}
+	if len(tsc.ingested) != 5 {
+		t.Errorf("%d ingested objects tracked, want 5", len(tsc.ingested))
+	}
+}
+
+// subtitlePlaylist is the sliding window of the segment muxer, 012.vtt
+// being written already.
+const subtitlePlaylist = "#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:10\n#EXTINF:2.000000,\n010.vtt\n#EXTINF:2.000000,\n011.vtt\n"
+
+func TestPruneSubtitles(t *testing.T) {
+	names := []string{"008.vtt", "009.vtt", "010.vtt", "011.vtt", "012.vtt"}
+	want := "010.vtt,011.vtt,012.vtt"
+
+	t.Run("ingested", func(t *testing.T) {
+		tsc := NewTranscoder("rtmp://example.com/live/stream", "test")
+		tsc.SetConfig([]string{"360p"}, false, "h264", "aac")
+		tsc.SetSubtitleTracks([]SubtitleTrack{{Index: 0}})
+		store := &mapStore{objects: make(map[string]string)}
+		tsc.storage = store
+		ctx := context.Background()
+		for _, name := range names {
+			if err := tsc.Ingest(ctx, "subs_0/"+name, strings.NewReader("WEBVTT\n\n"), 8); err != nil {
+				t.Fatalf("Ingest(%s) error = %v", name, err)
+			}
+		}
+		if err := tsc.Ingest(ctx, "subs_0/subs_0.m3u8", strings.NewReader(subtitlePlaylist), int64(len(subtitlePlaylist))); err != nil {
+			t.Fatalf("Ingest() of the playlist error = %v", err)
+		}
+
+		var got []string
+		for key := range store.objects {
+			if strings.HasSuffix(key, ".vtt") {
+				got = append(got, strings.TrimPrefix(key, "test/subs_0/"))
+			}
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != want {
+			t.Errorf("segments left = %v, want %s", got, want)
+		}
+		if len(tsc.ingested) != 4 {
+			t.Errorf("%d ingested objects tracked, want 4", len(tsc.ingested))
+		}
+	})
+
+	t.Run("disk", func(t *testing.T) {
+		tsc := NewTranscoder("rtmp://example.com/live/stream", "test")
+		tsc.OutputDir = t.TempDir()
+		dir := filepath.Join(tsc.OutputDir, "subs_0")
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tsc.pruneDisk("subs_0", []byte(subtitlePlaylist))
+
+		matches, _ := filepath.Glob(filepath.Join(dir, "*.vtt"))
+		var got []string
+		for _, m := range matches {
+			got = append(got, filepath.Base(m))
+		}
+		if strings.Join(got, ",") != want {
+			t.Errorf("segments left = %v, want %s", got, want)
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package transcoder
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/meanii/hlsproxy/internal/encoder"
+	"github.com/meanii/hlsproxy/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// codec returns the encoder package codec of the video codec.
+func (vc VideoCodecType) codec() encoder.Codec {
+	switch vc {
+	case H265:
+		return encoder.H265
+	case AV1:
+		return encoder.AV1
+	case VP9:
+		return encoder.VP9
+	}
+	return encoder.H264
+}
+
+// SetEncoder selects the encoder of the stream by its registered name,
+// overriding the node's configured encoder.
+func (t *Transcoder) SetEncoder(name string) {
+	if name != "" {
+		zap.S().Infof("setting up encoder %s", name)
+		t.EncoderName = name
+	}
+}
+
+// selectEncoder resolves and probes the stream's encoder.
+func (t *Transcoder) selectEncoder(ctx context.Context) error {
+	_, span := tracing.Tracer().Start(ctx, "encoder.select", trace.WithAttributes(tracing.StreamID(t.ID),
+		attribute.String("hlsproxy.encoder", t.EncoderName), attribute.String("hlsproxy.codec", string(t.VideoCodec.codec()))))
+	defer span.End()
+
+	enc, err := encoder.Select(t.EncoderName, t.VideoCodec.codec(), t.FfmpegBin)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	t.encoder = enc
+	return nil
+}
+
+// videoEncoder returns the selected encoder, the default one until
+// selectEncoder ran.
+func (t *Transcoder) videoEncoder() encoder.Encoder {
+	if t.encoder != nil {
+		return t.encoder
+	}
+	enc, _ := encoder.Lookup(encoder.DefaultName)
+	return enc
+}
+
+// rendition describes the video of a varient for the encoder.
+func (t *Transcoder) rendition(varient string) encoder.Rendition {
+	metadata := t.varientParams(varient)
+	width, height := resolutionSize(metadata.Resolution)
+	return encoder.Rendition{
+		Codec:           t.VideoCodec.codec(),
+		Width:           width,
+		Height:          height,
+		Bitrate:         int(metadata.Bandwidth / 1000),
+		FrameRate:       t.FrameRate,
+		GOP:             t.gopSize(),
+		SegmentDuration: segmentDuration,
+	}
+}
+
+// SegmentType returns the hls segment container of the codec. Only H.264
+// is carried in MPEG-TS, everything else needs fragmented mp4.
+func (vc VideoCodecType) SegmentType() string {
+	if vc == H264 {
+		return "mpegts"
+	}
+	return "fmp4"
+}
+
+// SegmentExtension returns the file extension of the codec's media segments.
+func (vc VideoCodecType) SegmentExtension() string {
+	return segmentExtension(vc.SegmentType())
+}
+
+func segmentExtension(segmentType string) string {
+	if segmentType == "fmp4" {
+		return ".m4s"
+	}
+	return ".ts"
+}
+
+// resolutionSize returns the width and height of a WxH resolution.
+func resolutionSize(resolution string) (int, int) {
+	width, height, _ := strings.Cut(resolution, "x")
+	w, _ := strconv.Atoi(width)
+	h, _ := strconv.Atoi(height)
+	return w, h
+}
@@ -0,0 +1,211 @@
+package transcoder
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/meanii/hlsproxy/config"
+	"github.com/meanii/hlsproxy/internal/events"
+	"github.com/meanii/hlsproxy/internal/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultProbeInterval = 30 * time.Second
+	probeTimeout         = 10 * time.Second
+)
+
+// SetBackups sets the sources tried in order when the primary one fails.
+func (t *Transcoder) SetBackups(sources []string) {
+	for _, source := range sources {
+		if source != "" && source != t.Source {
+			t.Backups = append(t.Backups, source)
+		}
+	}
+}
+
+// sources returns the primary source followed by the backups.
+func (t *Transcoder) sources() []string {
+	return append([]string{t.Source}, t.Backups...)
+}
+
+// SourceIndex returns the index of the source in use, 0 being the primary.
+func (t *Transcoder) SourceIndex() int {
+	t.Mux.RLock()
+	defer t.Mux.RUnlock()
+	return t.source
+}
+
+// currentSource returns the source in use, or the slate past the sources.
+func (t *Transcoder) currentSource() string {
+	sources := t.sources()
+	if index := t.SourceIndex(); index < len(sources) {
+		return sources[index]
+	}
+	return t.Slate
+}
+
+// prepareRestart sets the arguments ffmpeg restarts with after an exit. It
+// moves to the next source, the slate coming last, unless the exit was
+// caused by a switch already, and resumes the segment numbering.
+func (t *Transcoder) prepareRestart() {
+	count := len(t.sources())
+	if t.Slate != "" {
+		count++
+	}
+	t.resumeNumbering()
+
+	t.Mux.Lock()
+	next := t.source
+	if t.switching {
+		t.switching = false
+	} else {
+		next = (t.source + 1) % count
+	}
+	t.Mux.Unlock()
+	t.useSource(next, "failure")
+}
+
+// useSource makes ffmpeg read the given source from its next start on.
+func (t *Transcoder) useSource(index int, reason string) bool {
+	cmd := t.Cmd()
+	if cmd == nil {
+		return false
+	}
+
+	t.Mux.Lock()
+	from := t.source
+	t.source = index
+	t.Mux.Unlock()
+
+	args, err := t.generateArgs()
+	if err != nil {
+		zap.S().Errorf("transcoder: failed to switch stream %s to source %d, Error: %s", t.ID, index, err)
+		t.Mux.Lock()
+		t.source = from
+		t.Mux.Unlock()
+		return false
+	}
+	cmd.SetArgs(args)
+	if index == from {
+		return true
+	}
+
+	zap.S().Warnf("transcoder: switching stream %s from source %d to %d, reason: %s", t.ID, from, index, reason)
+	metrics.SourceSwitches.WithLabelValues(reason).Inc()
+	events.Publish(events.Event{Type: events.StreamSourceSwitched, StreamID: t.ID, Data: map[string]any{
+		"from":   from,
+		"to":     index,
+		"reason": reason,
+	}})
+	return true
+}
+
+// watchSources probes the primary source while the stream runs on a backup
+// one, when configured to return to it, and every source in order while it
+// shows its slate. ffmpeg is restarted on the first reachable one.
+func (t *Transcoder) watchSources(ctx context.Context) {
+	failover := config.GetConfig("").Config.Ffmpeg.Failover
+	interval := failover.ProbeInterval
+	if interval <= 0 {
+		interval = defaultProbeInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var candidates []string
+		reason := "primary_recovered"
+		switch {
+		case t.onSlate():
+			candidates = t.sources()
+			reason = "source_recovered"
+		case t.SourceIndex() > 0 && failover.ReturnToPrimary:
+			candidates = t.sources()[:1]
+		}
+
+		for index, source := range candidates {
+			if err := t.probeSource(ctx, source); err != nil {
+				zap.S().Debugf("transcoder: source %d of stream %s is still down, Error: %s", index, t.ID, err)
+				continue
+			}
+			t.restartOn(index, reason)
+			break
+		}
+	}
+}
+
+// restartOn restarts ffmpeg on the given source.
+func (t *Transcoder) restartOn(index int, reason string) {
+	// the restart must not fail over to the next source
+	t.Mux.Lock()
+	t.switching = true
+	t.Mux.Unlock()
+	if !t.useSource(index, reason) || !t.Cmd().Restart() {
+		// nothing exits, the next failure must fail over as usual
+		t.Mux.Lock()
+		t.switching = false
+		t.Mux.Unlock()
+	}
+}
+
+// sourceAudioStreams returns the number of audio streams of the source in
+// use, probed once per source. It is 0 when the source couldn't be probed.
+func (t *Transcoder) sourceAudioStreams() int {
+	source := t.currentSource()
+	t.Mux.RLock()
+	n, ok := t.audioStreams[source]
+	t.Mux.RUnlock()
+	if ok {
+		return n
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	// without an output ffmpeg exits with an error once it described the input
+	out, _ := exec.CommandContext(ctx, t.FfmpegBin, "-hide_banner", "-nostdin", "-i", source).CombinedOutput()
+	n, err := countAudioStreams(string(out))
+	if err != nil {
+		zap.S().Warnf("transcoder: failed to probe the audio of stream %s source, Error: %s", t.ID, err)
+		return 0
+	}
+	t.Mux.Lock()
+	t.audioStreams[source] = n
+	t.Mux.Unlock()
+	return n
+}
+
+var audioStreamLine = regexp.MustCompile(`^\s*Stream #0:\d+.*: Audio: `)
+
+// countAudioStreams counts the audio streams of the first input ffmpeg
+// described in its output.
+func countAudioStreams(out string) (int, error) {
+	if !strings.Contains(out, "Input #0") {
+		return 0, errors.New("ffmpeg didn't open the source")
+	}
+	n := 0
+	for _, line := range strings.Split(out, "\n") {
+		if audioStreamLine.MatchString(line) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// probeSource reads a second of the source.
+func (t *Transcoder) probeSource(ctx context.Context, source string) error {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	return exec.CommandContext(ctx, t.FfmpegBin,
+		"-hide_banner", "-nostdin", "-v", "error", "-i", source, "-t", "1", "-f", "null", "-").Run()
+}
@@ -0,0 +1,223 @@
+package transcoder
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/meanii/hlsproxy/internal/externalcmd"
+)
+
+const (
+	primarySource = "rtmp://example.com/live/primary"
+	backupSource  = "rtmp://example.com/live/backup"
+	slateImage    = "slate.png"
+)
+
+// failoverTranscoder returns a stream with a backup source and the given
+// slate, run by the fake ffmpeg which is restarted with the args the
+// stream generates.
+func failoverTranscoder(t *testing.T, slate string) (*Transcoder, *externalcmd.Cmd) {
+	t.Helper()
+	tsc := NewTranscoder(primarySource, "failover")
+	tsc.SetConfig([]string{"360p"}, false, "h264", "aac")
+	tsc.SetBackups([]string{backupSource})
+	tsc.Slate = slate
+	tsc.OutputDir = t.TempDir()
+	tsc.FfmpegBin = os.Args[0]
+
+	args, err := tsc.generateArgs()
+	if err != nil {
+		t.Fatalf("generateArgs() error = %v", err)
+	}
+	cmd := externalcmd.NewCmd(externalcmd.NewPool(), args, true, externalcmd.RestartPolicy{},
+		externalcmd.Environment{fakeFfmpegEnv: "1"}, externalcmd.Output{Stdout: io.Discard, Stderr: io.Discard}, nil, tsc.ID)
+	t.Cleanup(cmd.Close)
+	tsc.Mux.Lock()
+	tsc.cmd = cmd
+	tsc.Mux.Unlock()
+	return tsc, cmd
+}
+
+// input returns the first input of an ffmpeg command.
+func input(cmd *externalcmd.Cmd) string {
+	if inputs := argsOf(cmd.Args(), "-i"); len(inputs) > 0 {
+		return inputs[0]
+	}
+	return ""
+}
+
+// stop closes cmd and returns its exit.
+func stop(t *testing.T, cmd *externalcmd.Cmd) externalcmd.ExitResult {
+	t.Helper()
+	cmd.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if exit := cmd.LastExit(); exit != nil && exit.Stopped() {
+			return *exit
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("ffmpeg wasn't stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOnExitFailsOver(t *testing.T) {
+	crash := externalcmd.ExitResult{Code: 1, Err: errors.New("exit status 1")}
+	restart := externalcmd.ExitResult{Code: -1, Signal: "terminated", Err: errors.New("signal: terminated"), Requested: true}
+	tests := []struct {
+		name      string
+		slate     string
+		from      int
+		switching bool
+		exit      externalcmd.ExitResult
+		want      int
+		wantInput string
+	}{
+		{name: "primary fails", slate: slateImage, from: 0, exit: crash, want: 1, wantInput: backupSource},
+		{name: "last backup fails onto the slate", slate: slateImage, from: 1, exit: crash, want: 2, wantInput: slateImage},
+		{name: "slate wraps around to the primary", slate: slateImage, from: 2, exit: crash, want: 0, wantInput: primarySource},
+		{name: "last backup wraps around without slate", from: 1, exit: crash, want: 0, wantInput: primarySource},
+		{name: "watchdog restart fails over", from: 0, exit: restart, want: 1, wantInput: backupSource},
+		{name: "switch back to the primary", slate: slateImage, from: 0, switching: true, exit: restart, want: 0, wantInput: primarySource},
+		{name: "switch off the slate", slate: slateImage, from: 1, switching: true, exit: restart, want: 1, wantInput: backupSource},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tsc, cmd := failoverTranscoder(t, tt.slate)
+			if !tsc.useSource(tt.from, "test") {
+				t.Fatalf("useSource(%d) failed", tt.from)
+			}
+			tsc.Mux.Lock()
+			tsc.switching = tt.switching
+			tsc.Mux.Unlock()
+
+			tsc.onExit(tt.exit)
+
+			if got := tsc.SourceIndex(); got != tt.want {
+				t.Errorf("SourceIndex() = %d, want %d", got, tt.want)
+			}
+			if got := input(cmd); got != tt.wantInput {
+				t.Errorf("ffmpeg restarts on %q, want %q", got, tt.wantInput)
+			}
+			tsc.Mux.RLock()
+			switching := tsc.switching
+			tsc.Mux.RUnlock()
+			if switching {
+				t.Error("switching is still set, the next failure wouldn't fail over")
+			}
+		})
+	}
+}
+
+func TestOnExitStoppedKeepsSource(t *testing.T) {
+	tsc, cmd := failoverTranscoder(t, slateImage)
+	tsc.useSource(1, "test")
+
+	tsc.onExit(stop(t, cmd))
+	if got := tsc.SourceIndex(); got != 1 {
+		t.Errorf("SourceIndex() = %d after a stop, want 1", got)
+	}
+}
+
+func TestRestartOn(t *testing.T) {
+	tsc, cmd := failoverTranscoder(t, slateImage)
+	tsc.useSource(2, "test")
+	if !waitSpawned(tsc) {
+		t.Fatal("ffmpeg wasn't started")
+	}
+
+	tsc.restartOn(0, "source_recovered")
+	if got := tsc.SourceIndex(); got != 0 {
+		t.Errorf("SourceIndex() = %d, want the primary", got)
+	}
+	if got := input(cmd); got != primarySource {
+		t.Errorf("ffmpeg restarts on %q, want %q", got, primarySource)
+	}
+	tsc.Mux.RLock()
+	switching := tsc.switching
+	tsc.Mux.RUnlock()
+	if !switching {
+		t.Error("switching isn't set while ffmpeg restarts")
+	}
+
+	// the exit of the switch keeps the source
+	tsc.onExit(externalcmd.ExitResult{Code: -1, Signal: "terminated", Err: errors.New("signal: terminated"), Requested: true})
+	if got := tsc.SourceIndex(); got != 0 {
+		t.Errorf("SourceIndex() = %d after the switch, want the primary", got)
+	}
+}
+
+func TestRestartOnStopped(t *testing.T) {
+	tsc, cmd := failoverTranscoder(t, "")
+	tsc.useSource(1, "test")
+	stop(t, cmd)
+
+	// nothing exits, the next failure must fail over as usual
+	tsc.restartOn(0, "primary_recovered")
+	tsc.Mux.RLock()
+	switching := tsc.switching
+	tsc.Mux.RUnlock()
+	if switching {
+		t.Error("switching is set although ffmpeg wasn't restarted")
+	}
+}
+
+func TestWaitReadyAttempts(t *testing.T) {
+	crash := externalcmd.ExitResult{Code: 1, Err: errors.New("exit status 1")}
+	restart := externalcmd.ExitResult{Code: -1, Signal: "terminated", Err: errors.New("signal: terminated"), Requested: true}
+	_, cmd := failoverTranscoder(t, "")
+	stopped := stop(t, cmd)
+	crashLoop := externalcmd.ExitResult{Code: 1, Err: externalcmd.ErrCrashLoop}
+	tests := []struct {
+		name    string
+		backups []string
+		slate   string
+		exits   []externalcmd.ExitResult
+		// wantErr is false when the stream waits for its segments
+		wantErr bool
+	}{
+		{name: "single source", exits: []externalcmd.ExitResult{crash}, wantErr: true},
+		{name: "backup tried", backups: []string{backupSource}, exits: []externalcmd.ExitResult{crash}},
+		{name: "every source tried", backups: []string{backupSource}, exits: []externalcmd.ExitResult{crash, crash}, wantErr: true},
+		{name: "slate counted", backups: []string{backupSource}, slate: slateImage, exits: []externalcmd.ExitResult{crash, crash}},
+		{name: "slate tried", backups: []string{backupSource}, slate: slateImage, exits: []externalcmd.ExitResult{crash, crash, crash}, wantErr: true},
+		{name: "requested restarts don't count", exits: []externalcmd.ExitResult{restart, restart}},
+		{name: "stopped", backups: []string{backupSource}, exits: []externalcmd.ExitResult{stopped}, wantErr: true},
+		{name: "crash loop", backups: []string{backupSource}, exits: []externalcmd.ExitResult{crashLoop}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tsc := NewTranscoder(primarySource, "attempts")
+			tsc.SetConfig([]string{"360p"}, false, "h264", "aac")
+			tsc.SetBackups(tt.backups)
+			tsc.Slate = tt.slate
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			errs := make(chan error, 1)
+			go func() { errs <- tsc.waitReady(ctx) }()
+			for _, exit := range tt.exits {
+				tsc.exited <- exit
+			}
+
+			select {
+			case err := <-errs:
+				if !tt.wantErr {
+					t.Fatalf("waitReady() error = %v, want it waiting", err)
+				}
+				if !errors.Is(err, ErrFfmpegExited) {
+					t.Errorf("waitReady() error = %v, want ErrFfmpegExited", err)
+				}
+			case <-time.After(100 * time.Millisecond):
+				if tt.wantErr {
+					t.Fatal("waitReady() is still waiting, want ErrFfmpegExited")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package transcoder
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/meanii/hlsproxy/config"
+	"github.com/meanii/hlsproxy/internal/events"
+	"github.com/meanii/hlsproxy/internal/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultIngestURL = "http://127.0.0.1:8001/ingest/"
+	// ingestCleanupTimeout bounds the deletion of a stopped stream's objects
+	ingestCleanupTimeout = 30 * time.Second
+)
+
+// ingestEnabled reports whether ffmpeg PUTs its hls output to the proxy,
+// always the case with the memory storage so segments never touch the disk.
+func ingestEnabled() bool {
+	output := config.GetConfig("").Config.Output
+	return output.Ingest.Enabled || output.Storage.Type == "memory"
+}
+
+// ingestURL returns the URL ffmpeg PUTs the stream's objects under.
+func (t *Transcoder) ingestURL() string {
+	base := config.GetConfig("").Config.Output.Ingest.URL
+	if base == "" {
+		base = defaultIngestURL
+	}
+	return strings.TrimSuffix(base, "/") + "/" + t.ID
+}
+
+// outputPath returns where ffmpeg writes the file name of a rendition,
+// the ingest endpoint when enabled and the output directory otherwise.
+func (t *Transcoder) outputPath(rendition string, name string) string {
+	if ingestEnabled() {
+		return t.ingestURL() + "/" + rendition + "/" + name
+	}
+	return path.Join(t.OutputDir, rendition, name)
+}
+
+// ingestOptions returns the hls muxer options uploading over http.
+func ingestOptions() []string {
+	if !ingestEnabled() {
+		return nil
+	}
+	return []string{"-method", "PUT", "-http_persistent", "1"}
+}
+
+// Ingest stores an object ffmpeg uploaded for the stream into the
+// storage, name being relative to the stream directory, and publishes the
+// matching event. Playlists and WebVTT segments are edited before they
+// leave the disk, the proxy edits them on the fly otherwise.
+func (t *Transcoder) Ingest(ctx context.Context, name string, r io.Reader, size int64) error {
+	key := t.ID + "/" + name
+	counter := &countingReader{r: r}
+	var body io.Reader = counter
+	// text objects are small, playlists are read back to prune earlier runs
+	var data []byte
+	if ext := path.Ext(name); ext == ".m3u8" || ext == ".vtt" {
+		var err error
+		if data, err = io.ReadAll(counter); err != nil {
+			return err
+		}
+		stored := data
+		if !storage.IsLocal(t.storage) {
+			stored = t.filterObject(name, data)
+		}
+		body, size = bytes.NewReader(stored), int64(len(stored))
+	} else if size < 0 {
+		// ffmpeg uploads chunked, segments are a few MB and storages such
+		// as S3 fall back to huge multipart uploads without a length
+		segment, err := io.ReadAll(counter)
+		if err != nil {
+			return err
+		}
+		body, size = bytes.NewReader(segment), int64(len(segment))
+	}
+	if err := t.storage.Put(ctx, key, body, size, storage.ContentType(key)); err != nil {
+		return err
+	}
+	t.Mux.Lock()
+	t.ingested[key] = true
+	t.Mux.Unlock()
+
+	rendition := path.Dir(name)
+	switch path.Ext(name) {
+	case ".m3u8":
+		if rendition != "." {
+			t.pruneIngested(ctx, rendition, data)
+		}
+		events.Publish(events.Event{Type: events.PlaylistUpdated, StreamID: t.ID, Data: map[string]any{"rendition": rendition, "name": name}})
+	case ".ts", ".m4s":
+		t.segmentProduced(rendition, name, counter.n)
+	}
+	return nil
+}
+
+// IngestDelete removes an object ffmpeg dropped from the live window.
+func (t *Transcoder) IngestDelete(ctx context.Context, name string) error {
+	key := t.ID + "/" + name
+	if err := t.storage.Delete(ctx, key); err != nil {
+		return err
+	}
+	t.Mux.Lock()
+	delete(t.ingested, key)
+	t.Mux.Unlock()
+	events.Publish(events.Event{Type: events.SegmentDeleted, StreamID: t.ID, Data: map[string]any{"rendition": path.Dir(name), "name": name}})
+	return nil
+}
+
+// syncIngest stores the master playlist, ffmpeg doesn't upload it, and
+// deletes the objects ffmpeg uploaded once ctx is done. A local storage
+// is left to the removal of the output directory.
+func (t *Transcoder) syncIngest(ctx context.Context) {
+	if storage.IsLocal(t.storage) {
+		return
+	}
+	key := t.ID + "/" + t.MasterFileName
+	master := []byte(t.masterPlaylist("").String())
+	if err := t.storage.Put(ctx, key, bytes.NewReader(master), int64(len(master)), storage.ContentType(key)); err != nil {
+		zap.S().Warnf("transcoder: failed to store %s, Error: %s", key, err)
+	}
+
+	<-ctx.Done()
+	cleanupCtx, cancel := context.WithTimeout(context.Background(), ingestCleanupTimeout)
+	defer cancel()
+	t.Mux.Lock()
+	keys := make([]string, 0, len(t.ingested)+1)
+	for key := range t.ingested {
+		keys = append(keys, key)
+	}
+	t.ingested = make(map[string]bool)
+	t.Mux.Unlock()
+	for _, key := range append(keys, key) {
+		if err := t.storage.Delete(cleanupCtx, key); err != nil {
+			zap.S().Warnf("transcoder: failed to delete %s, Error: %s", key, err)
+		}
+	}
+}
+
+// countingReader counts the bytes read, uploads are usually chunked.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
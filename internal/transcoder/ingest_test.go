@@ -0,0 +1,109 @@
+package transcoder
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// mapStore is a remote storage keeping the objects in a map, and the
+// size they were put with.
+type mapStore struct {
+	mu      sync.Mutex
+	objects map[string]string
+	sizes   map[string]int64
+}
+
+func (s *mapStore) Put(_ context.Context, key string, r io.Reader, size int64, _ string) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = string(data)
+	if s.sizes != nil {
+		s.sizes[key] = size
+	}
+	return nil
+}
+
+func (s *mapStore) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *mapStore) URL(key string) string {
+	return "https://cdn.example.com/" + key
+}
+
+func TestIngestStoresIntoStorage(t *testing.T) {
+	store := &mapStore{objects: make(map[string]string)}
+	tsc := NewTranscoder("rtmp://example.com/live/stream", "test")
+	tsc.SetConfig([]string{"360p"}, false, "h264", "aac")
+	tsc.storage = store
+	ctx := context.Background()
+
+	objects := map[string]string{
+		"360p/000.ts":     "segment",
+		"subs_0/000.vtt":  "WEBVTT\n\n",
+		"360p/360p.m3u8":  "#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:2.000000,\n000.ts\n",
+		"subs_0/000.m3u8": "#EXTM3U\n",
+	}
+	for name, data := range objects {
+		if err := tsc.Ingest(ctx, name, strings.NewReader(data), int64(len(data))); err != nil {
+			t.Fatalf("Ingest(%s) error = %v", name, err)
+		}
+	}
+	if got := store.objects["test/360p/000.ts"]; got != "segment" {
+		t.Errorf("stored segment = %q, want %q", got, "segment")
+	}
+	if got := store.objects["test/subs_0/000.vtt"]; !strings.Contains(got, timestampMapHeader) {
+		t.Errorf("stored WebVTT segment has no timestamp map: %q", got)
+	}
+
+	if err := tsc.IngestDelete(ctx, "360p/000.ts"); err != nil {
+		t.Fatalf("IngestDelete() error = %v", err)
+	}
+	if _, ok := store.objects["test/360p/000.ts"]; ok {
+		t.Error("deleted segment is still stored")
+	}
+
+	// the master playlist is stored, everything is deleted once stopped
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		tsc.syncIngest(ctx)
+		close(done)
+	}()
+	cancel()
+	<-done
+	if len(store.objects) != 0 {
+		t.Errorf("objects left after the stream stopped: %v", store.objects)
+	}
+}
+
+func TestIngestChunked(t *testing.T) {
+	store := &mapStore{objects: make(map[string]string), sizes: make(map[string]int64)}
+	tsc := NewTranscoder("rtmp://example.com/live/stream", "test")
+	tsc.SetConfig([]string{"360p"}, false, "h264", "aac")
+	tsc.storage = store
+
+	// chunked uploads have no Content-Length
+	for _, name := range []string{"360p/000.ts", "360p/init.mp4", "360p/001.m4s"} {
+		if err := tsc.Ingest(context.Background(), name, strings.NewReader("segment"), -1); err != nil {
+			t.Fatalf("Ingest(%s) error = %v", name, err)
+		}
+		key := "test/" + name
+		if got := store.sizes[key]; got != int64(len("segment")) {
+			t.Errorf("%s put with size %d, want %d", key, got, len("segment"))
+		}
+		if got := store.objects[key]; got != "segment" {
+			t.Errorf("%s stored %q, want %q", key, got, "segment")
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package transcoder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/meanii/hlsproxy/config"
+)
+
+// fakeFfmpegEnv makes the test binary behave as ffmpeg instead of running
+// the tests: it lists libx264 among its encoders and otherwise runs until
+// it is stopped, the output being ingested by the tests.
+const fakeFfmpegEnv = "TRANSCODER_FAKE_FFMPEG"
+
+// TestMain loads the sample config, with the options changing the
+// generated commands turned off so each test sets the ones it covers.
+func TestMain(m *testing.M) {
+	if _, ok := os.LookupEnv(fakeFfmpegEnv); ok {
+		if slices.Contains(os.Args, "-encoders") {
+			fmt.Println(" V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC (codec h264)")
+			os.Exit(0)
+		}
+		time.Sleep(time.Minute)
+		os.Exit(1)
+	}
+
+	cfg := config.GetConfig("../../sample-config.yaml")
+	cfg.Config.Ffmpeg.Bin = "ffmpeg"
+	cfg.Config.Ffmpeg.Slate = ""
+	cfg.Config.Ffmpeg.Watchdog.Detect = nil
+	cfg.Config.Ffmpeg.Logs.Dirname = ""
+	cfg.Config.Output.Ingest.Enabled = false
+	os.Exit(m.Run())
+}
+
+// fakeTranscoder returns a stream run by the fake ffmpeg, uploading to
+// the ingest endpoint, its output directory under a temporary directory.
+func fakeTranscoder(t *testing.T, id string) *Transcoder {
+	t.Helper()
+	t.Setenv(fakeFfmpegEnv, "1")
+	output := &config.GetConfig("").Config.Output
+	wd, _ := os.Getwd()
+	dirname, err := filepath.Rel(wd, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func(dirname string) func() {
+		return func() { output.Dirname, output.Ingest.Enabled = dirname, false }
+	}(output.Dirname))
+	output.Dirname, output.Ingest.Enabled = dirname, true
+
+	tsc := NewTranscoder("rtmp://example.com/live/stream", id)
+	tsc.SetConfig([]string{"360p"}, false, "h264", "aac")
+	tsc.FfmpegBin = os.Args[0]
+	tsc.storage = &mapStore{objects: make(map[string]string)}
+	return tsc
+}
+
+// waitSpawned waits for the fake ffmpeg of a stream to be started.
+func waitSpawned(tsc *Transcoder) bool {
+	deadline := time.Now().Add(10 * time.Second)
+	for tsc.Cmd() == nil || tsc.Cmd().GetProcess() == nil {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
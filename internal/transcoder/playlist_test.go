@@ -0,0 +1,67 @@
+package transcoder
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMasterPlaylistAudioOnly(t *testing.T) {
+	tsc := NewTranscoder("rtmp://example.com/live/stream", "test")
+	tsc.SetConfig([]string{"audio"}, true, "h264", "aac")
+	tsc.SetAudioTracks([]AudioTrack{{Index: 0, Language: "en"}, {Index: 1, Language: "fr", Default: true}})
+	tsc.SetAudioCodecs([]string{"aac", "opus"})
+
+	got := tsc.masterPlaylist("").String()
+	for _, want := range []string{
+		"#EXT-X-STREAM-INF:PROGRAM-ID=0,BANDWIDTH=128000,CODECS=\"mp4a.40.2\",AUDIO=\"audio-aac\"\naudio_aac_1/audio_aac_1.m3u8\n",
+		"#EXT-X-STREAM-INF:PROGRAM-ID=0,BANDWIDTH=96000,CODECS=\"opus\",AUDIO=\"audio-opus\"\naudio_opus_1/audio_opus_1.m3u8\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("master playlist misses\n%s\ngot\n%s", want, got)
+		}
+	}
+	if n := strings.Count(got, "#EXT-X-STREAM-INF"); n != 2 {
+		t.Errorf("master playlist has %d variants, want 2:\n%s", n, got)
+	}
+}
+
+func TestAddTimestampMap(t *testing.T) {
+	tests := []struct {
+		name       string
+		videoCodec string
+		in         string
+		want       string
+	}{
+		{
+			name:       "mpegts",
+			videoCodec: "h264",
+			in:         "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nhello\n",
+			want:       "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:126000,LOCAL:00:00:00.000\n\n00:00:01.000 --> 00:00:02.000\nhello\n",
+		},
+		{
+			name:       "fmp4",
+			videoCodec: "hevc",
+			in:         "WEBVTT\n\n",
+			want:       "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:0,LOCAL:00:00:00.000\n\n",
+		},
+		{
+			name:       "already mapped",
+			videoCodec: "h264",
+			in:         "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\n",
+			want:       "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\n",
+		},
+		{
+			name:       "not webvtt",
+			videoCodec: "h264",
+			in:         "#EXTM3U\n",
+			want:       "#EXTM3U\n",
+		},
+	}
+	for _, tt := range tests {
+		tsc := NewTranscoder("rtmp://example.com/live/stream", "test")
+		tsc.SetConfig([]string{"360p"}, false, tt.videoCodec, "aac")
+		if got := string(tsc.filterObject("test/subs_0/001.vtt", []byte(tt.in))); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
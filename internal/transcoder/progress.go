@@ -0,0 +1,90 @@
+package transcoder
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Progress is the latest encoding progress reported by ffmpeg -progress.
+type Progress struct {
+	Frame       int64         `json:"frame"`
+	FPS         float64       `json:"fps"`
+	BitrateKbps float64       `json:"bitrate_kbps"`
+	TotalSize   int64         `json:"total_size"`
+	OutTime     time.Duration `json:"out_time"`
+	DupFrames   int64         `json:"dup_frames"`
+	DropFrames  int64         `json:"drop_frames"`
+	Speed       float64       `json:"speed"`
+	Ended       bool          `json:"ended"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+}
+
+// progressParser is an io.Writer decoding the key=value blocks ffmpeg writes
+// with -progress. Each block ends with a progress=continue|end line.
+type progressParser struct {
+	partial []byte
+	current Progress
+	onBlock func(Progress)
+}
+
+func newProgressParser(onBlock func(Progress)) *progressParser {
+	return &progressParser{onBlock: onBlock}
+}
+
+func (pp *progressParser) Write(p []byte) (int, error) {
+	buf := append(pp.partial, p...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		pp.parseLine(strings.TrimSpace(string(buf[:i])))
+		buf = buf[i+1:]
+	}
+	pp.partial = append([]byte(nil), buf...)
+	return len(p), nil
+}
+
+func (pp *progressParser) parseLine(line string) {
+	key, value, found := strings.Cut(line, "=")
+	if !found {
+		return
+	}
+	value = strings.TrimSpace(value)
+
+	switch key {
+	case "frame":
+		pp.current.Frame = parseInt(value)
+	case "fps":
+		pp.current.FPS = parseFloat(value)
+	case "bitrate":
+		pp.current.BitrateKbps = parseFloat(strings.TrimSuffix(value, "kbits/s"))
+	case "total_size":
+		pp.current.TotalSize = parseInt(value)
+	case "out_time_us":
+		pp.current.OutTime = time.Duration(parseInt(value)) * time.Microsecond
+	case "dup_frames":
+		pp.current.DupFrames = parseInt(value)
+	case "drop_frames":
+		pp.current.DropFrames = parseInt(value)
+	case "speed":
+		pp.current.Speed = parseFloat(strings.TrimSuffix(value, "x"))
+	case "progress":
+		pp.current.Ended = value == "end"
+		pp.current.UpdatedAt = time.Now()
+		pp.onBlock(pp.current)
+	}
+}
+
+// parseInt and parseFloat treat ffmpeg's "N/A" as zero.
+func parseInt(value string) int64 {
+	n, _ := strconv.ParseInt(value, 10, 64)
+	return n
+}
+
+func parseFloat(value string) float64 {
+	f, _ := strconv.ParseFloat(value, 64)
+	return f
+}
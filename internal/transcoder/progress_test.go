@@ -0,0 +1,86 @@
+package transcoder
+
+import (
+	"testing"
+	"time"
+)
+
+const progressBlocks = `frame=120
+fps=29.97
+stream_0_0_q=23.0
+bitrate=1234.5kbits/s
+total_size=524288
+out_time_us=4000000
+out_time=00:00:04.000000
+dup_frames=1
+drop_frames=2
+speed=1.01x
+progress=continue
+frame=150
+fps=N/A
+bitrate=N/A
+total_size=N/A
+out_time_us=N/A
+dup_frames=1
+drop_frames=2
+speed=N/A
+progress=end
+`
+
+func TestProgressParser(t *testing.T) {
+	want := []Progress{
+		{Frame: 120, FPS: 29.97, BitrateKbps: 1234.5, TotalSize: 524288, OutTime: 4 * time.Second, DupFrames: 1, DropFrames: 2, Speed: 1.01},
+		{Frame: 150, DupFrames: 1, DropFrames: 2, Ended: true},
+	}
+	tests := []struct {
+		name string
+		// chunk is the size of the writes, the whole output at once when 0
+		chunk int
+	}{
+		{name: "single write"},
+		{name: "lines split across writes", chunk: 7},
+		{name: "byte by byte", chunk: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []Progress
+			pp := newProgressParser(func(p Progress) { got = append(got, p) })
+			chunk := tt.chunk
+			if chunk == 0 {
+				chunk = len(progressBlocks)
+			}
+			for i := 0; i < len(progressBlocks); i += chunk {
+				end := min(i+chunk, len(progressBlocks))
+				if n, err := pp.Write([]byte(progressBlocks[i:end])); n != end-i || err != nil {
+					t.Fatalf("Write() = %d, %v, want %d, nil", n, err, end-i)
+				}
+			}
+
+			if len(got) != len(want) {
+				t.Fatalf("%d blocks parsed, want %d", len(got), len(want))
+			}
+			for i := range want {
+				if got[i].UpdatedAt.IsZero() {
+					t.Errorf("block %d has no update time", i)
+				}
+				got[i].UpdatedAt = time.Time{}
+				if got[i] != want[i] {
+					t.Errorf("block %d = %+v, want %+v", i, got[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestProgressParserPartialBlock(t *testing.T) {
+	blocks := 0
+	pp := newProgressParser(func(Progress) { blocks++ })
+	pp.Write([]byte("frame=1\nfps=25\nprogress=cont"))
+	if blocks != 0 {
+		t.Fatalf("%d blocks reported before progress= was written in full", blocks)
+	}
+	pp.Write([]byte("inue\r\n"))
+	if blocks != 1 {
+		t.Errorf("%d blocks reported, want 1", blocks)
+	}
+}
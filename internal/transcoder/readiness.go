@@ -0,0 +1,216 @@
+package transcoder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/meanii/hlsproxy/config"
+	"github.com/meanii/hlsproxy/internal/events"
+	"github.com/meanii/hlsproxy/internal/externalcmd"
+	"github.com/meanii/hlsproxy/internal/metrics"
+	"github.com/meanii/hlsproxy/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultReadyTimeout     = 30 * time.Second
+	defaultReadyMinSegments = 1
+)
+
+var (
+	// ErrReadyTimeout is returned by Run when the renditions didn't get
+	// their first segments within the readiness timeout.
+	ErrReadyTimeout = errors.New("transcoder: stream wasn't ready before the timeout")
+	// ErrFfmpegExited is returned by Run when ffmpeg exited before the
+	// stream was ready.
+	ErrFfmpegExited = errors.New("transcoder: ffmpeg exited before the stream was ready")
+	// ErrNoCapacity is returned by Run when the node runs max_streams already.
+	ErrNoCapacity = errors.New("transcoder: no capacity left for another stream")
+	// ErrStreamExists is returned by Run when a stream with the same ID runs.
+	ErrStreamExists = errors.New("transcoder: a stream with this id is already running")
+)
+
+func readyTimeout() time.Duration {
+	if timeout := config.GetConfig("").Config.Ffmpeg.Readiness.Timeout; timeout > 0 {
+		return timeout
+	}
+	return defaultReadyTimeout
+}
+
+func readyMinSegments() int {
+	if n := config.GetConfig("").Config.Ffmpeg.Readiness.MinSegments; n > 0 {
+		return n
+	}
+	return defaultReadyMinSegments
+}
+
+// liveRenditions returns the renditions which must have segments before
+// the stream is ready. Subtitles only carry cues when there is speech and
+// don't count.
+func (t *Transcoder) liveRenditions() []string {
+	renditions := t.videoVarients()
+	for _, codec := range t.audioCodecs() {
+		for i := range t.audioTracks() {
+			renditions = append(renditions, audioRendition(codec, i))
+		}
+	}
+	return renditions
+}
+
+// waitReady blocks until every rendition produced the configured number
+// of segments. It gives up on timeout, when ffmpeg exits on every source
+// or when ctx is done.
+func (t *Transcoder) waitReady(ctx context.Context) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "transcoder.waitReady", trace.WithAttributes(tracing.StreamID(t.ID),
+		attribute.Int("hlsproxy.renditions", len(t.liveRenditions()))))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	zap.S().Infof("transcoder: waiting for stream %s to be ready", t.ID)
+	timeout := time.NewTimer(readyTimeout())
+	defer timeout.Stop()
+
+	// streams with backups try each of their sources once, then the slate
+	attempts := len(t.sources())
+	if t.Slate != "" {
+		attempts++
+	}
+	for {
+		select {
+		case <-t.live:
+			zap.S().Infof("transcoder: stream %s ready to play", t.ID)
+			return nil
+		case res := <-t.exited:
+			if res.Requested && !res.Stopped() {
+				// restarted on purpose, e.g. to switch sources
+				continue
+			}
+			attempts--
+			if attempts > 0 && !res.Stopped() && !errors.Is(res.Err, externalcmd.ErrCrashLoop) {
+				zap.S().Warnf("transcoder: stream %s ffmpeg %s before it was ready, trying the next source", t.ID, res)
+				continue
+			}
+			return fmt.Errorf("%w: %s", ErrFfmpegExited, res)
+		case <-timeout.C:
+			return fmt.Errorf("%w after %s", ErrReadyTimeout, readyTimeout())
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// segmentArrived counts a segment of a rendition and marks the
+// stream live once every rendition has enough of them.
+func (t *Transcoder) segmentArrived(rendition string) {
+	t.Mux.Lock()
+	t.segments[rendition]++
+	t.lastSegments[rendition] = time.Now()
+	for _, r := range t.liveRenditions() {
+		if t.segments[r] < readyMinSegments() {
+			t.Mux.Unlock()
+			return
+		}
+	}
+	t.Mux.Unlock()
+	t.markLive()
+}
+
+// markLive closes t.live, once.
+func (t *Transcoder) markLive() {
+	t.liveOnce.Do(func() {
+		close(t.live)
+		metrics.TimeToFirstSegment.Observe(time.Since(t.startedAt).Seconds())
+		zap.S().Infof("transcoder: stream %s is live", t.ID)
+		events.Publish(events.Event{Type: events.StreamLive, StreamID: t.ID})
+	})
+}
+
+// notifyExit wakes up waitReady when ffmpeg exits before the stream is ready.
+func (t *Transcoder) notifyExit(res externalcmd.ExitResult) {
+	select {
+	case t.exited <- res:
+	default:
+	}
+}
+
+// startFailureReason labels why a stream didn't get ready, for metrics.
+func startFailureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrReadyTimeout):
+		return "timeout"
+	case errors.Is(err, ErrFfmpegExited):
+		return "ffmpeg_exited"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, ErrNoCapacity):
+		return "capacity"
+	case errors.Is(err, ErrStreamExists):
+		return "duplicate"
+	}
+	return "error"
+}
+
+// stop terminates ffmpeg and forgets the stream, used when it never got
+// ready. A stream stopped on request while starting was cleaned up by
+// whoever stopped it, its ID may already be reused.
+func (t *Transcoder) stop() {
+	if cmd := t.Cmd(); cmd != nil {
+		if exit := cmd.LastExit(); exit != nil && exit.Stopped() {
+			return
+		}
+	}
+	t.Stop()
+}
+
+// Stop terminates ffmpeg, forgets the stream and deletes its output.
+func (t *Transcoder) Stop() {
+	if cmd := t.Cmd(); cmd != nil {
+		cmd.Close()
+	}
+	Remove(t.ID)
+	os.RemoveAll(t.OutputDir)
+}
+
+// State returns the lifecycle state of the stream, "starting" until it
+// is ready to play, "degraded" while the watchdog flags it and the state
+// of ffmpeg otherwise.
+func (t *Transcoder) State() string {
+	cmd := t.Cmd()
+	if cmd == nil {
+		return "starting"
+	}
+	state := cmd.State()
+	if state == externalcmd.StateRunning && !t.isLive() {
+		return "starting"
+	}
+	if state == externalcmd.StateRunning && len(t.Degraded()) > 0 {
+		return "degraded"
+	}
+	return state.String()
+}
+
+// Failed reports whether ffmpeg crash looped and won't be restarted.
+func (t *Transcoder) Failed() bool {
+	cmd := t.Cmd()
+	return cmd != nil && cmd.State() == externalcmd.StateFailed
+}
+
+func (t *Transcoder) isLive() bool {
+	select {
+	case <-t.live:
+		return true
+	default:
+		return false
+	}
+}
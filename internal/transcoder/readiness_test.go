@@ -0,0 +1,35 @@
+package transcoder
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestStopWhileStarting(t *testing.T) {
+	tsc := fakeTranscoder(t, "stopped-while-starting")
+	errs := make(chan error, 1)
+	go func() {
+		_, err := tsc.Run(context.Background())
+		errs <- err
+	}()
+	if !waitSpawned(tsc) {
+		t.Fatal("ffmpeg wasn't started")
+	}
+
+	// DELETE stops the stream and forgets it, a new one takes the ID
+	tsc.Cmd().Close()
+	Remove(tsc.ID)
+	next := NewTranscoder("rtmp://example.com/live/next", tsc.ID)
+	if err := tryRegister(next); err != nil {
+		t.Fatalf("tryRegister() error = %v", err)
+	}
+	defer Remove(next.ID)
+
+	if err := <-errs; !errors.Is(err, ErrFfmpegExited) {
+		t.Errorf("Run() error = %v, want ErrFfmpegExited", err)
+	}
+	if got, ok := Lookup(next.ID); !ok || got != next {
+		t.Error("the failed start forgot the stream which reused its ID")
+	}
+}
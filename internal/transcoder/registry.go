@@ -0,0 +1,102 @@
+package transcoder
+
+import (
+	"sync"
+
+	"github.com/meanii/hlsproxy/config"
+	"github.com/meanii/hlsproxy/internal/events"
+	"github.com/meanii/hlsproxy/internal/metrics"
+)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]*Transcoder)
+)
+
+// Lookup returns the running transcoder of the given stream.
+func Lookup(id string) (*Transcoder, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	t, ok := registry[id]
+	return t, ok
+}
+
+// Remove forgets the transcoder of the given stream and releases
+// its resources. It doesn't stop the underlying command.
+func Remove(id string) {
+	registryMu.Lock()
+	t, ok := registry[id]
+	delete(registry, id)
+	registryMu.Unlock()
+
+	if ok {
+		t.close()
+		publishCapacity()
+	}
+	metrics.ForgetStream(id)
+}
+
+// Count returns the number of registered streams holding a max_streams
+// slot, failed streams stay registered for their history but hold none.
+func Count() int {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return occupied()
+}
+
+// HasCapacity reports whether the node may start another stream.
+func HasCapacity() bool {
+	max := config.GetConfig("").Config.Ffmpeg.MaxStreams
+	return max <= 0 || Count() < max
+}
+
+// occupied is Count for callers holding registryMu.
+func occupied() int {
+	n := 0
+	for _, t := range registry {
+		if !t.Failed() {
+			n++
+		}
+	}
+	return n
+}
+
+// tryRegister registers t unless a stream with its ID is registered or the
+// node runs max_streams already, checked and registered atomically so
+// concurrent starts can't overshoot the capacity.
+func tryRegister(t *Transcoder) error {
+	max := config.GetConfig("").Config.Ffmpeg.MaxStreams
+	registryMu.Lock()
+	if _, ok := registry[t.ID]; ok {
+		registryMu.Unlock()
+		return ErrStreamExists
+	}
+	if max > 0 && occupied() >= max {
+		registryMu.Unlock()
+		return ErrNoCapacity
+	}
+	registry[t.ID] = t
+	registryMu.Unlock()
+	publishCapacity()
+	return nil
+}
+
+// publishCapacity tells subscribers how many streams the node runs.
+func publishCapacity() {
+	events.Publish(events.Event{Type: events.CapacityChanged, Data: map[string]any{
+		"streams":      Count(),
+		"max_streams":  config.GetConfig("").Config.Ffmpeg.MaxStreams,
+		"has_capacity": HasCapacity(),
+	}})
+}
+
+// StateCounts counts the registered streams by lifecycle state.
+func StateCounts() map[string]int {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	counts := make(map[string]int)
+	for _, t := range registry {
+		counts[t.State()]++
+	}
+	return counts
+}
@@ -0,0 +1,108 @@
+package transcoder
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meanii/hlsproxy/config"
+	"github.com/meanii/hlsproxy/internal/externalcmd"
+)
+
+func TestTryRegisterDuplicate(t *testing.T) {
+	first := NewTranscoder("rtmp://example.com/live/stream", "duplicate")
+	if err := tryRegister(first); err != nil {
+		t.Fatalf("tryRegister() error = %v", err)
+	}
+	defer Remove(first.ID)
+
+	second := NewTranscoder("rtmp://example.com/live/other", "duplicate")
+	if err := tryRegister(second); !errors.Is(err, ErrStreamExists) {
+		t.Errorf("tryRegister() of a duplicate ID error = %v, want ErrStreamExists", err)
+	}
+	if got, _ := Lookup("duplicate"); got != first {
+		t.Error("the duplicate replaced the running stream")
+	}
+}
+
+func TestTryRegisterCapacity(t *testing.T) {
+	ffmpeg := &config.GetConfig("").Config.Ffmpeg
+	defer func(max int) { ffmpeg.MaxStreams = max }(ffmpeg.MaxStreams)
+	ffmpeg.MaxStreams = 3
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	registered, rejected := 0, 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := tryRegister(NewTranscoder("rtmp://example.com/live/stream", fmt.Sprintf("capacity-%d", i)))
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				registered++
+			case errors.Is(err, ErrNoCapacity):
+				rejected++
+			default:
+				t.Errorf("tryRegister() error = %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 20; i++ {
+		Remove(fmt.Sprintf("capacity-%d", i))
+	}
+
+	if registered != 3 || rejected != 17 {
+		t.Errorf("registered %d and rejected %d streams, want 3 and 17", registered, rejected)
+	}
+}
+
+func TestFailedStreamReleasesCapacity(t *testing.T) {
+	ffmpeg := &config.GetConfig("").Config.Ffmpeg
+	defer func(max int) { ffmpeg.MaxStreams = max }(ffmpeg.MaxStreams)
+	ffmpeg.MaxStreams = 1
+
+	// the binary can't be spawned, the first restart gives up
+	failed := NewTranscoder("rtmp://example.com/live/stream", "failed")
+	if err := tryRegister(failed); err != nil {
+		t.Fatalf("tryRegister() error = %v", err)
+	}
+	defer Remove(failed.ID)
+	policy := externalcmd.RestartPolicy{InitialDelay: time.Millisecond, MaxRestarts: 1}
+	cmd := externalcmd.NewCmd(externalcmd.NewPool(), []string{filepath.Join(t.TempDir(), "ffmpeg")},
+		true, policy, make(externalcmd.Environment), externalcmd.Output{Stdout: io.Discard, Stderr: io.Discard}, nil, failed.ID)
+	defer cmd.Close()
+	failed.Mux.Lock()
+	failed.cmd = cmd
+	failed.Mux.Unlock()
+
+	next := NewTranscoder("rtmp://example.com/live/next", "next")
+	if err := tryRegister(next); !errors.Is(err, ErrNoCapacity) {
+		t.Fatalf("tryRegister() while the stream runs error = %v, want ErrNoCapacity", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for !failed.Failed() {
+		if time.Now().After(deadline) {
+			t.Fatalf("stream is %s, want failed", failed.State())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !HasCapacity() {
+		t.Error("HasCapacity() = false once the stream failed")
+	}
+	if err := tryRegister(next); err != nil {
+		t.Errorf("tryRegister() once the stream failed error = %v", err)
+	}
+	defer Remove(next.ID)
+	if _, ok := Lookup(failed.ID); !ok {
+		t.Error("the failed stream was forgotten, its history can't be read")
+	}
+}
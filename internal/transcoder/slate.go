@@ -0,0 +1,63 @@
+package transcoder
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/meanii/hlsproxy/internal/ffmpeg"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSlateFrameRate = 25
+	// slateAudio is the silence streamed along the slate
+	slateAudio = "anullsrc=r=48000:cl=stereo"
+)
+
+// SetSlate overrides the configured slate of the stream.
+func (t *Transcoder) SetSlate(slate string) {
+	if slate != "" {
+		zap.S().Infof("setting up slate %s", slate)
+		t.Slate = slate
+	}
+}
+
+// onSlate reports whether the stream shows its slate, as none of its
+// sources is available.
+func (t *Transcoder) onSlate() bool {
+	return t.Slate != "" && t.SourceIndex() == len(t.sources())
+}
+
+// slateInputs adds the slate, looped in real time, and silent audio as
+// the inputs 0 and 1.
+func (t *Transcoder) slateInputs(args *ffmpeg.Args) {
+	switch strings.ToLower(path.Ext(t.Slate)) {
+	case ".png", ".jpg", ".jpeg", ".bmp", ".webp":
+		frameRate := t.FrameRate
+		if frameRate <= 0 {
+			frameRate = defaultSlateFrameRate
+		}
+		args.Input(t.Slate, "-re", "-loop", "1", "-framerate", strconv.FormatFloat(frameRate, 'f', -1, 64))
+	default:
+		args.Input(t.Slate, "-re", "-stream_loop", "-1")
+	}
+	args.Input(slateAudio, "-f", "lavfi")
+}
+
+// slateScale fits the slate in the rendition without distorting it,
+// padding the rest with black.
+func slateScale(width, height int) string {
+	return fmt.Sprintf("scale=w=%d:h=%d:force_original_aspect_ratio=decrease:force_divisible_by=2,"+
+		"pad=w=%d:h=%d:x=(ow-iw)/2:y=(oh-ih)/2,setsar=1", width, height, width, height)
+}
+
+// audioMap returns the -map specifier of an audio track, the silence
+// while on the slate.
+func (t *Transcoder) audioMap(track AudioTrack) string {
+	if t.onSlate() {
+		return "1:a:0"
+	}
+	return fmt.Sprintf("0:a:%d", track.Index)
+}
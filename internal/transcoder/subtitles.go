@@ -0,0 +1,169 @@
+package transcoder
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/grafov/m3u8"
+)
+
+const (
+	subtitlesGroupID = "subs"
+	captionsGroupID  = "cc"
+
+	timestampMapHeader = "X-TIMESTAMP-MAP="
+	// mpegtsTimestampOffset is the first timestamp of ffmpeg's MPEG-TS
+	// output, its muxer delays them by twice the default -muxdelay of 0.7s
+	mpegtsTimestampOffset = 126000
+)
+
+// SubtitleTrack is a text subtitle stream of the source, published as
+// segmented WebVTT.
+type SubtitleTrack struct {
+	// Index is the index of the source subtitle stream, as in -map 0:s:<Index>.
+	Index    int    `json:"index"`
+	Language string `json:"language"`
+	Name     string `json:"name"`
+	Default  bool   `json:"default"`
+	Forced   bool   `json:"forced"`
+}
+
+// CaptionChannel is a CEA-608/708 caption service embedded in the video,
+// signalled in the master playlist.
+type CaptionChannel struct {
+	// InstreamID is CC1-CC4 for CEA-608 or SERVICE1-SERVICE63 for CEA-708.
+	InstreamID string `json:"instream_id"`
+	Language   string `json:"language"`
+	Name       string `json:"name"`
+	Default    bool   `json:"default"`
+}
+
+// SetSubtitleTracks selects the source subtitle streams converted to WebVTT.
+func (t *Transcoder) SetSubtitleTracks(tracks []SubtitleTrack) {
+	t.SubtitleTracks = tracks
+}
+
+// SetCaptions declares the caption services carried in the source video.
+// They are passed through the encoders and signalled with CLOSED-CAPTIONS.
+func (t *Transcoder) SetCaptions(channels []CaptionChannel) {
+	t.Captions = channels
+}
+
+// subtitleRendition returns the output directory name of the i-th subtitle track.
+func subtitleRendition(i int) string {
+	return "subs_" + strconv.Itoa(i)
+}
+
+// subtitleAlternatives returns the EXT-X-MEDIA entries of the subtitle
+// group, with URIs prefixed by uriPrefix.
+func (t *Transcoder) subtitleAlternatives(uriPrefix string) []*m3u8.Alternative {
+	alternatives := make([]*m3u8.Alternative, 0, len(t.SubtitleTracks))
+	for i, track := range t.SubtitleTracks {
+		rendition := subtitleRendition(i)
+		name := track.Name
+		if name == "" {
+			name = fmt.Sprintf("subtitles %d", i+1)
+			if track.Language != "" {
+				name = track.Language
+			}
+		}
+
+		alternative := &m3u8.Alternative{
+			Type:       "SUBTITLES",
+			GroupId:    subtitlesGroupID,
+			Name:       name,
+			Language:   track.Language,
+			Default:    track.Default,
+			Autoselect: "YES",
+			URI:        fmt.Sprintf("%s%s/%s.m3u8", uriPrefix, rendition, rendition),
+		}
+		if track.Forced {
+			alternative.Forced = "YES"
+		}
+		alternatives = append(alternatives, alternative)
+	}
+	return alternatives
+}
+
+// subtitleOutputOptions returns the ffmpeg output options converting the
+// i-th subtitle track into WebVTT segments and a live playlist.
+func (t *Transcoder) subtitleOutputOptions(i int, track SubtitleTrack) []string {
+	rendition := subtitleRendition(i)
+	t.Mux.RLock()
+	startNumber := t.nextSegment
+	t.Mux.RUnlock()
+	return []string{
+		"-map", fmt.Sprintf("0:s:%d", track.Index),
+		"-c:s", "webvtt",
+		"-f", "segment",
+		"-segment_start_number", strconv.Itoa(startNumber),
+		"-segment_time", strconv.Itoa(segmentDuration),
+		"-segment_format", "webvtt",
+		"-segment_list", t.outputPath(rendition, rendition+".m3u8"),
+		"-segment_list_type", "m3u8",
+		"-segment_list_size", "10",
+		"-segment_list_flags", "+live",
+	}
+}
+
+// addTimestampMap maps the cue times of a WebVTT segment to the timestamps
+// of the media segments, which players otherwise assume start at 0.
+func (t *Transcoder) addTimestampMap(data []byte) []byte {
+	if !bytes.HasPrefix(data, []byte("WEBVTT")) || bytes.Contains(data, []byte(timestampMapHeader)) {
+		return data
+	}
+	offset := 0
+	if t.VideoCodec.SegmentType() == "mpegts" {
+		offset = mpegtsTimestampOffset
+	}
+	header, body, _ := bytes.Cut(data, []byte("\n"))
+	out := append([]byte(nil), header...)
+	out = fmt.Appendf(out, "\n%sMPEGTS:%d,LOCAL:00:00:00.000\n", timestampMapHeader, offset)
+	return append(out, body...)
+}
+
+// closedCaptionsTag writes the EXT-X-MEDIA entries of the caption group,
+// which the m3u8 package can't express since it lacks INSTREAM-ID.
+type closedCaptionsTag struct {
+	channels []CaptionChannel
+}
+
+func (tag closedCaptionsTag) TagName() string {
+	return "#EXT-X-MEDIA"
+}
+
+func (tag closedCaptionsTag) Encode() *bytes.Buffer {
+	if len(tag.channels) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for i, channel := range tag.channels {
+		if i > 0 {
+			buf.WriteRune('\n')
+		}
+		name := channel.Name
+		if name == "" {
+			name = channel.InstreamID
+		}
+		fmt.Fprintf(&buf, "#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID=\"%s\",NAME=\"%s\"", captionsGroupID, name)
+		if channel.Default {
+			buf.WriteString(",DEFAULT=YES,AUTOSELECT=YES")
+		} else {
+			buf.WriteString(",DEFAULT=NO,AUTOSELECT=YES")
+		}
+		if channel.Language != "" {
+			fmt.Fprintf(&buf, ",LANGUAGE=\"%s\"", channel.Language)
+		}
+		fmt.Fprintf(&buf, ",INSTREAM-ID=\"%s\"", channel.InstreamID)
+	}
+	return &buf
+}
+
+func (tag closedCaptionsTag) String() string {
+	if buf := tag.Encode(); buf != nil {
+		return buf.String()
+	}
+	return ""
+}
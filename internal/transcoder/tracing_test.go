@@ -0,0 +1,78 @@
+package transcoder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/meanii/hlsproxy/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestRunSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	shutdown := tracing.SetExporter(exporter)
+	defer shutdown(context.Background())
+
+	// the segments are ingested once the fake ffmpeg runs
+	tsc := fakeTranscoder(t, "traced")
+	go func() {
+		if !waitSpawned(tsc) {
+			return
+		}
+		for i := 0; i < readyMinSegments(); i++ {
+			name := fmt.Sprintf("360p/%03d.ts", i)
+			tsc.Ingest(context.Background(), name, strings.NewReader("segment"), 7)
+		}
+	}()
+	_, err := tsc.Run(context.Background())
+	if cmd := tsc.Cmd(); cmd != nil {
+		cmd.Close()
+	}
+	Remove(tsc.ID)
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	tests := []struct {
+		name  string
+		attrs []attribute.KeyValue
+	}{
+		{name: "transcoder.Run", attrs: []attribute.KeyValue{tracing.StreamID("traced")}},
+		{name: "encoder.select", attrs: []attribute.KeyValue{tracing.StreamID("traced"), attribute.String("hlsproxy.codec", "h264")}},
+		{name: "ffmpeg.spawn", attrs: []attribute.KeyValue{tracing.StreamID("traced"), attribute.String("process.executable.path", os.Args[0])}},
+		{name: "transcoder.waitReady", attrs: []attribute.KeyValue{tracing.StreamID("traced"), attribute.Int("hlsproxy.renditions", 1)}},
+	}
+	run := spans["transcoder.Run"]
+	for _, tt := range tests {
+		span, ok := spans[tt.name]
+		if !ok {
+			t.Errorf("no %s span among %d spans", tt.name, len(spans))
+			continue
+		}
+		for _, want := range tt.attrs {
+			if !hasAttribute(span.Attributes, want) {
+				t.Errorf("%s span misses %s=%s: %v", tt.name, want.Key, want.Value.Emit(), span.Attributes)
+			}
+		}
+		if tt.name != "transcoder.Run" && span.Parent.SpanID() != run.SpanContext.SpanID() {
+			t.Errorf("%s span isn't a child of transcoder.Run", tt.name)
+		}
+	}
+}
+
+func hasAttribute(attrs []attribute.KeyValue, want attribute.KeyValue) bool {
+	for _, attr := range attrs {
+		if attr.Key == want.Key && attr.Value == want.Value {
+			return true
+		}
+	}
+	return false
+}
@@ -1,21 +1,47 @@
 package transcoder
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"path"
-	"strings"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/grafov/m3u8"
 	"github.com/meanii/hlsproxy/config"
+	"github.com/meanii/hlsproxy/internal/codecs"
+	"github.com/meanii/hlsproxy/internal/encoder"
+	"github.com/meanii/hlsproxy/internal/events"
 	"github.com/meanii/hlsproxy/internal/externalcmd"
-	"github.com/meanii/hlsproxy/pkg/utils"
+	"github.com/meanii/hlsproxy/internal/ffmpeg"
+	"github.com/meanii/hlsproxy/internal/metrics"
+	"github.com/meanii/hlsproxy/internal/storage"
+	"github.com/meanii/hlsproxy/internal/streamlog"
+	"github.com/meanii/hlsproxy/internal/tracing"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
-const DefaultResolution = "720p"
+const (
+	DefaultResolution = "720p"
+
+	defaultLogBufferLines = 1000
+
+	// progressEventInterval is the minimum interval between progress events of a stream.
+	progressEventInterval = 2 * time.Second
+
+	// segmentDuration is the target hls segment length in seconds.
+	segmentDuration = 2
+	// defaultGOPSize is used when the source frame rate is unknown,
+	// two seconds at 30fps.
+	defaultGOPSize = 60
+)
 
 type (
 	VideoCodecType int
@@ -25,28 +51,31 @@ type (
 const (
 	H264 VideoCodecType = iota
 	H265
+	AV1
+	VP9
 )
 
 const (
 	AAC AudioCodecType = iota
+	EAC3
+	AC3
+	Opus
 )
 
-func (vc VideoCodecType) StringFourCC() string {
-	switch vc {
-	case H265:
-		return "hev1.1.6.L93.B0"
-	case H264:
-		return "avc1.4d40"
-	}
-	return "avc1.4d40"
-}
-
+// StringFourCC returns the RFC 6381 codec of the audio we encode,
+// plain AAC-LC for AAC.
 func (ac AudioCodecType) StringFourCC() string {
 	switch ac {
 	case AAC:
-		return "mp4a.40.5"
+		return codecs.MP4A(codecs.AACLC)
+	case EAC3:
+		return codecs.EAC3
+	case AC3:
+		return codecs.AC3
+	case Opus:
+		return codecs.Opus
 	}
-	return "mp4a.40.5"
+	return codecs.MP4A(codecs.AACLC)
 }
 
 func (vc VideoCodecType) String() string {
@@ -55,6 +84,10 @@ func (vc VideoCodecType) String() string {
 		return "H265"
 	case H264:
 		return "H264"
+	case AV1:
+		return "AV1"
+	case VP9:
+		return "VP9"
 	}
 	return "H264"
 }
@@ -63,6 +96,12 @@ func (ac AudioCodecType) String() string {
 	switch ac {
 	case AAC:
 		return "AAC"
+	case EAC3:
+		return "EAC3"
+	case AC3:
+		return "AC3"
+	case Opus:
+		return "OPUS"
 	}
 	return "AAC"
 }
@@ -72,15 +111,57 @@ type Transcoder struct {
 	MasterFileName string
 	FfmpegBin      string
 	Source         string
+	Backups        []string
+	Slate          string
 	Varients       []string
 	VideoCodec     VideoCodecType
 	AudioCodec     AudioCodecType
+	EncoderName    string
 	FrameRate      float64
 	AudioEnable    bool
+	AudioTracks    []AudioTrack
+	AudioCodecs    []AudioCodecType
+	AudioOptions   AudioOptions
+	SubtitleTracks []SubtitleTrack
+	Captions       []CaptionChannel
 	OutputDir      string
 	MasterHls      string
+	Logs           *streamlog.Buffer
 	Mux            sync.RWMutex
-	wg             sync.WaitGroup
+
+	cmd     *externalcmd.Cmd
+	encoder encoder.Encoder
+	storage storage.Storage
+	// cancel stops the background work of the stream, sync and watch
+	cancel   context.CancelFunc
+	progress Progress
+	// progressPublishedAt throttles the progress events
+	progressPublishedAt time.Time
+	logFile             io.Closer
+	startedAt           time.Time
+	// live is closed once every rendition has enough segments
+	live     chan struct{}
+	liveOnce sync.Once
+	segments map[string]int
+	exited   chan externalcmd.ExitResult
+	// watchdog state: segment times per rendition, detected conditions by
+	// start time and raised conditions with their action
+	lastSegments map[string]time.Time
+	detected     map[string]time.Time
+	raised       map[string]string
+	stallActedAt time.Time
+	// source is the index of the source in use, switching is set while
+	// ffmpeg restarts on purpose to switch it
+	source    int
+	switching bool
+	// nextSegment is the number the segments continue from after a
+	// restart, discontinuities the first segment numbers of each restart
+	nextSegment     int
+	discontinuities []int
+	// ingested holds the storage keys of the objects ffmpeg uploaded
+	ingested map[string]bool
+	// audioStreams counts the audio streams of the sources probed so far
+	audioStreams map[string]int
 }
 
 func NewTranscoder(source string, ID string) *Transcoder {
@@ -90,12 +171,23 @@ func NewTranscoder(source string, ID string) *Transcoder {
 	}
 
 	tscconfig.FfmpegBin = config.GetConfig("").Config.Ffmpeg.Bin
+	tscconfig.EncoderName = config.GetConfig("").Config.Ffmpeg.Encoder
+	tscconfig.Slate = config.GetConfig("").Config.Ffmpeg.Slate
+	tscconfig.storage = storage.GetStorage()
 	tscconfig.Varients = []string{"240p", "360p", "audio"}
 
 	tscconfig.VideoCodec = H264
 	tscconfig.AudioCodec = AAC
 
 	tscconfig.MasterFileName = "playlist.m3u8"
+	tscconfig.live = make(chan struct{})
+	tscconfig.segments = make(map[string]int)
+	tscconfig.ingested = make(map[string]bool)
+	tscconfig.audioStreams = make(map[string]int)
+	tscconfig.lastSegments = make(map[string]time.Time)
+	tscconfig.detected = make(map[string]time.Time)
+	tscconfig.raised = make(map[string]string)
+	tscconfig.exited = make(chan externalcmd.ExitResult, 1)
 	return &tscconfig
 }
 
@@ -115,8 +207,12 @@ func (t *Transcoder) SetConfig(varients []string, audio bool, videoCodec string,
 		switch videoCodec {
 		case "h264":
 			t.VideoCodec = H264
-		case "h265":
+		case "h265", "hevc":
 			t.VideoCodec = H265
+		case "av1":
+			t.VideoCodec = AV1
+		case "vp9":
+			t.VideoCodec = VP9
 		default:
 			t.VideoCodec = H264
 		}
@@ -124,116 +220,356 @@ func (t *Transcoder) SetConfig(varients []string, audio bool, videoCodec string,
 
 	if audioCodec != "" {
 		zap.S().Infof("setting up audioCodec %s", audioCodec)
-		switch audioCodec {
-		case "AAC":
-			t.AudioCodec = AAC
-		default:
-			t.AudioCodec = AAC
+		codec, ok := ParseAudioCodec(audioCodec)
+		if !ok {
+			codec = AAC
 		}
+		t.AudioCodec = codec
 	}
 }
 
-func (t *Transcoder) Run() (string, error) {
+// Run starts ffmpeg and returns the master playlist once the stream is
+// ready to play. A stream that doesn't get ready, because of the timeout,
+// ffmpeg exiting or ctx being done, is stopped and the error returned.
+func (t *Transcoder) Run(ctx context.Context) (_ string, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "transcoder.Run", trace.WithAttributes(tracing.StreamID(t.ID)))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	// registering first holds the slot and the ID while ffmpeg starts, and
+	// ffmpeg uploads to the ingest endpoint right away
+	t.startedAt = time.Now()
+	if err := tryRegister(t); err != nil {
+		metrics.StartFailures.WithLabelValues(startFailureReason(err)).Inc()
+		return "", err
+	}
+	if err := t.selectEncoder(ctx); err != nil {
+		metrics.StartFailures.WithLabelValues("encoder").Inc()
+		Remove(t.ID)
+		return "", err
+	}
 	t.prepareOutputDir()
-	cmdstring := t.generateCmdString()
-	_, err := t.generateMasterHls()
+	cmdargs, err := t.generateArgs()
+	if err != nil {
+		metrics.StartFailures.WithLabelValues("encoder").Inc()
+		Remove(t.ID)
+		return "", err
+	}
+	_, err = t.generateMasterHls()
 	if err != nil {
 		zap.S().Errorf("failed to start trasncoder, Error: %s", err)
 	}
 
-	initialMasterHls := m3u8.NewMasterPlaylist()
+	initialMasterHls := t.masterPlaylist(t.storage.URL(t.ID + "/"))
+
+	zap.S().Infof("transcoder, generated master.m3u8 hls file\nm3u8file: %s", initialMasterHls.String())
+
+	t.setupLogs()
+	output := externalcmd.Output{
+		Stdout: newProgressParser(t.setProgress),
+		Stderr: t.Logs,
+	}
+
+	// spawns, restarts included, are recorded in the trace of this run
+	spawnCtx := trace.ContextWithSpanContext(context.Background(), span.SpanContext())
+	cmdrunnerpool := externalcmd.NewPool()
+	rtmpPullCmd := externalcmd.NewCmdContext(spawnCtx,
+		cmdrunnerpool, cmdargs, true, t.restartPolicy(), make(externalcmd.Environment), output, t.onExit, t.ID)
+
+	t.Mux.Lock()
+	t.cmd = rtmpPullCmd
+	t.Mux.Unlock()
+	t.startBackground()
+	events.Publish(events.Event{Type: events.StreamCreated, StreamID: t.ID, Data: map[string]any{"varients": t.Varients}})
+
+	if err := t.waitReady(ctx); err != nil {
+		zap.S().Errorf("transcoder: stream %s isn't ready, stopping it, Error: %s", t.ID, err)
+		metrics.StartFailures.WithLabelValues(startFailureReason(err)).Inc()
+		events.Publish(events.Event{Type: events.StreamFailed, StreamID: t.ID, Data: map[string]any{"reason": startFailureReason(err), "error": err.Error()}})
+		t.stop()
+		return "", err
+	}
+	return initialMasterHls.String(), nil
+}
+
+// setupLogs captures ffmpeg's stderr into a per-stream ring buffer and,
+// when configured, a rotating log file.
+func (t *Transcoder) setupLogs() {
+	logs := config.GetConfig("").Config.Ffmpeg.Logs
+	lines := logs.BufferLines
+	if lines <= 0 {
+		lines = defaultLogBufferLines
+	}
 
-	for index, varient := range t.Varients {
-		varientName := t.Varients[index]
-		varientURL := fmt.Sprintf("http://localhost:8001/hlsproxy/%s/%s/%s.m3u8", t.ID, varientName, varientName)
-		genrateVarient := m3u8.Variant{
-			URI:           varientURL,
-			VariantParams: t.getVideoMeatadata(varient),
+	var file io.Writer
+	if logs.Dirname != "" {
+		wd, _ := os.Getwd()
+		logpath := path.Join(wd, logs.Dirname, t.ID+".log")
+		rf, err := streamlog.NewRotatingFile(logpath, logs.MaxSize, logs.MaxBackups)
+		if err != nil {
+			zap.S().Warnf("transcoder: failed to open log file %s, Error: %s", logpath, err)
+		} else {
+			file = rf
+			t.logFile = rf
 		}
-		initialMasterHls.Variants = append(initialMasterHls.Variants, &genrateVarient)
+	}
+	t.Logs = streamlog.NewBuffer(lines, file)
+}
 
-		zap.S().Infof("transcoder, generated %s.m3u8 hls file, %s", varientName)
+// close releases the resources of a stream that stopped.
+func (t *Transcoder) close() {
+	t.Mux.RLock()
+	cancel := t.cancel
+	t.Mux.RUnlock()
+	if cancel != nil {
+		cancel()
 	}
+	if t.logFile != nil {
+		t.logFile.Close()
+	}
+}
 
-	t.wg.Add(1)
+// startBackground watches the playlists ffmpeg writes to disk, unless it
+// uploads them to the ingest endpoint, runs the watchdog, probes the
+// sources of streams on a backup or their slate and copies the output
+// ffmpeg writes to disk to a memory or remote storage. Ingested objects
+// are stored as they are uploaded.
+func (t *Transcoder) startBackground() {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Mux.Lock()
+	t.cancel = cancel
+	t.Mux.Unlock()
+
+	if !ingestEnabled() {
+		go t.watchPlaylists(ctx)
+	}
+	go t.watchdog(ctx)
+	if t.Slate != "" || len(t.Backups) > 0 && config.GetConfig("").Config.Ffmpeg.Failover.ReturnToPrimary {
+		go t.watchSources(ctx)
+	}
+	if ingestEnabled() {
+		go t.syncIngest(ctx)
+	} else if !storage.IsLocal(t.storage) {
+		root := path.Dir(t.OutputDir)
+		syncer := storage.NewSyncer(t.storage, root, t.ID)
+		syncer.SetFilter(t.filterObject)
+		go syncer.Run(ctx)
+	}
+}
 
-	zap.S().Infof("transcoder, generated master.m3u8 hls file, %s\nm3u8file: %s", initialMasterHls.Variants[len(initialMasterHls.Variants)-1].URI, initialMasterHls.String())
+func (t *Transcoder) setProgress(progress Progress) {
+	t.Mux.Lock()
+	t.progress = progress
+	publish := time.Since(t.progressPublishedAt) >= progressEventInterval
+	if publish {
+		t.progressPublishedAt = time.Now()
+	}
+	t.Mux.Unlock()
 
-	cmdrunnerpool := externalcmd.NewPool()
-	rtmpPullCmd := externalcmd.NewCmd(
-		cmdrunnerpool, cmdstring, true, make(externalcmd.Environment), nil, t.ID)
-	rtmpPullCmd.SetStreamID(t.ID)
+	if publish {
+		events.Publish(events.Event{Type: events.StreamProgress, StreamID: t.ID, Data: map[string]any{"progress": progress}})
+	}
+}
 
-	t.isReadToPlay()
-	t.wg.Wait()
-	return initialMasterHls.String(), nil
+// Progress returns the latest progress reported by ffmpeg.
+func (t *Transcoder) Progress() Progress {
+	t.Mux.RLock()
+	defer t.Mux.RUnlock()
+	return t.progress
+}
+
+// Cmd returns the external command running ffmpeg.
+func (t *Transcoder) Cmd() *externalcmd.Cmd {
+	t.Mux.RLock()
+	defer t.Mux.RUnlock()
+	return t.cmd
 }
 
-func (t *Transcoder) isReadToPlay() {
-	zap.S().Infof("transcoder: waiting for transcoder to start")
-	t.checkGeneratedTS()
-	zap.S().Infof("transcoder: ready to play")
+func (t *Transcoder) restartPolicy() externalcmd.RestartPolicy {
+	restart := config.GetConfig("").Config.Ffmpeg.Restart
+	return externalcmd.RestartPolicy{
+		InitialDelay: restart.InitialDelay,
+		MaxDelay:     restart.MaxDelay,
+		Multiplier:   restart.Multiplier,
+		Jitter:       restart.Jitter,
+		MaxRestarts:  restart.MaxRestarts,
+		Window:       restart.Window,
+	}
+}
+
+func (t *Transcoder) onExit(res externalcmd.ExitResult) {
+	t.notifyExit(res)
+	data := map[string]any{"exit": res.String(), "code": res.Code}
+	switch {
+	case res.Stopped():
+		zap.S().Infof("transcoder: stream %s %s", t.ID, res)
+		events.Publish(events.Event{Type: events.StreamStopped, StreamID: t.ID, Data: data})
+	case errors.Is(res.Err, externalcmd.ErrCrashLoop):
+		zap.S().Errorf("transcoder: stream %s failed, Error: %s", t.ID, res.Err)
+		data["reason"] = "crash_loop"
+		events.Publish(events.Event{Type: events.StreamFailed, StreamID: t.ID, Data: data})
+		// the failed stream released its slot
+		publishCapacity()
+	default:
+		if !res.Success() && !res.Requested {
+			zap.S().Warnf("transcoder: stream %s ffmpeg %s", t.ID, res)
+		}
+		if res.Code < 0 && res.Signal == "" {
+			metrics.SpawnFailures.Inc()
+		}
+		if !res.Requested {
+			metrics.FfmpegRestarts.WithLabelValues(t.ID).Inc()
+		}
+		events.Publish(events.Event{Type: events.StreamRestarted, StreamID: t.ID, Data: data})
+		t.prepareRestart()
+	}
 }
 
-func (t *Transcoder) checkGeneratedTS() error {
-	var foundTSChunks bool
-	for {
-		files := utils.FindFiles(t.OutputDir, ".ts")
-		zap.S().Infof("transcoder: found %d chunks", len(files))
-		for _, file := range files {
-			zap.S().Infof("transcoder: found %s file", file)
-			if strings.HasSuffix(file, ".ts") {
-				zap.S().Infof("transcoder: found %s", file)
-				foundTSChunks = true
-				break
+// generateArgs builds the ffmpeg argument list, the binary first.
+// The source is decoded once and split into a scaled stream per video
+// variant, all encoded with aligned GOPs so players can switch cleanly.
+func (t *Transcoder) generateArgs() ([]string, error) {
+	args := ffmpeg.NewArgs().
+		Global("-loglevel", "repeat+level+verbose", "-progress", "pipe:1", "-nostats")
+	slate := t.onSlate()
+	if slate {
+		t.slateInputs(args)
+	} else {
+		args.Input(t.currentSource())
+	}
+
+	videoVarients := t.videoVarients()
+	detectLabel := ""
+	if len(videoVarients) > 0 {
+		outputs := len(videoVarients)
+		// a slate is frozen, and silent, on purpose
+		if hasVideoDetectors() && !slate {
+			// one more copy for the watchdog's detectors
+			outputs++
+			detectLabel = fmt.Sprintf("[v%d]", len(videoVarients))
+		}
+		split := fmt.Sprintf("[0:v]split=%d", outputs)
+		for index := 0; index < outputs; index++ {
+			split += fmt.Sprintf("[v%d]", index)
+		}
+		args.Filter(split)
+	}
+	if !slate {
+		for _, filter := range t.detectorFilters(detectLabel) {
+			args.Filter(filter)
+		}
+	}
+
+	enc := t.videoEncoder()
+	for index, varient := range videoVarients {
+		rendition := t.rendition(varient)
+		label := fmt.Sprintf("[v%dout]", index)
+		if slate {
+			args.Filter(fmt.Sprintf("[v%d]%s%s", index, slateScale(rendition.Width, rendition.Height), label))
+		} else {
+			args.Filter(fmt.Sprintf("[v%d]scale=w=%d:h=%d%s", index, rendition.Width, rendition.Height, label))
+		}
+
+		options := []string{"-map", label}
+		if !t.audioEnabled() {
+			// without demuxed renditions the source audio stays muxed in
+			if slate {
+				options = append(options, "-map", "1:a")
+			} else {
+				options = append(options, "-map", "0:a?")
 			}
+			options = append(options, t.audioEncoderOptions(t.AudioCodec)...)
+		}
+		encoderOptions, err := enc.Args(rendition)
+		if err != nil {
+			return nil, fmt.Errorf("encoder %s: %w", enc.Name(), err)
+		}
+		options = append(options, encoderOptions...)
+		args.Output(t.outputPath(varient, varient+".m3u8"),
+			append(options, t.hlsOptions(varient, t.VideoCodec.SegmentType())...)...)
+	}
+
+	for _, codec := range t.audioCodecs() {
+		for i, track := range t.audioTracks() {
+			rendition := audioRendition(codec, i)
+			args.Output(t.outputPath(rendition, rendition+".m3u8"), t.audioOutputOptions(codec, i, track)...)
 		}
-		if foundTSChunks {
+	}
+
+	for i, track := range t.SubtitleTracks {
+		if slate {
 			break
 		}
-		time.Sleep(1 * time.Second)
+		rendition := subtitleRendition(i)
+		args.Output(t.outputPath(rendition, "%03d.vtt"), t.subtitleOutputOptions(i, track)...)
 	}
-	t.wg.Done()
-	return nil
-}
 
-func (t *Transcoder) generateCmdString() string {
-	prefix := fmt.Sprintf("%s -i \"%s\" -loglevel repeat+level+verbose -profile:v baseline -level 3.0 ", t.FfmpegBin, t.Source)
-	suffixtree := make([]string, 0)
+	argv := append([]string{t.FfmpegBin}, args.Build()...)
+	if wrapper, ok := enc.(encoder.CommandWrapper); ok {
+		argv = wrapper.Wrap(argv)
+	}
+	zap.S().Infof("generated ffmpeg args: %q", argv)
+	return argv, nil
+}
 
+// videoVarients returns the varients carrying video, in ladder order.
+func (t *Transcoder) videoVarients() []string {
+	varients := make([]string, 0, len(t.Varients))
 	for _, varient := range t.Varients {
-		resolution := t.getVideoMeatadata(varient).Resolution
 		if varient != "audio" {
-			segmentFilename := "%03d.ts"
-			cmd := fmt.Sprintf("-s %s -start_number 0 -hls_time 2 -hls_list_size 10 -hls_flags delete_segments+split_by_time -hls_segment_filename %s/%s/%s -b:v 500k -maxrate 500k -bufsize 1000k -f hls %s/%s/%s.m3u8 ",
-				resolution,
-				t.OutputDir,
-				varient,
-				segmentFilename,
-				t.OutputDir,
-				varient,
-				varient,
-			)
-			suffixtree = append(suffixtree, cmd)
+			varients = append(varients, varient)
 		}
+	}
+	return varients
+}
 
-		if varient == "audio" {
-			segmentFilename := "%03d.ts"
-			cmd := fmt.Sprintf("-map 0:a -start_number 0 -hls_time 2 -hls_list_size 10 -hls_flags delete_segments+split_by_time -hls_segment_filename %s/audio/%s -b:a 128k -f hls %s/audio/audio.m3u8 ",
-				t.OutputDir,
-				segmentFilename,
-				t.OutputDir,
-			)
-			suffixtree = append(suffixtree, cmd)
+func (t *Transcoder) hasVarient(name string) bool {
+	for _, varient := range t.Varients {
+		if varient == name {
+			return true
 		}
-
 	}
+	return false
+}
 
-	suffixtreeString := strings.Join(suffixtree, " ")
-	cmdstring := fmt.Sprintf("%s %s", prefix, suffixtreeString)
-	zap.S().Infof("generated cmd string: %s", cmdstring)
+// gopSize returns the keyframe interval in frames, one GOP per segment.
+func (t *Transcoder) gopSize() int {
+	if t.FrameRate > 0 {
+		return int(math.Round(t.FrameRate * segmentDuration))
+	}
+	return defaultGOPSize
+}
 
-	return cmdstring
+// hlsOptions returns the hls muxer options of a variant output
+// written with the given segment type.
+func (t *Transcoder) hlsOptions(varient string, segmentType string) []string {
+	t.Mux.RLock()
+	startNumber := t.nextSegment
+	t.Mux.RUnlock()
+
+	flags := "delete_segments+split_by_time"
+	if startNumber > 0 {
+		// resuming a stream, the new playlist starts with a discontinuity
+		flags += "+discont_start"
+	}
+	options := []string{
+		"-start_number", strconv.Itoa(startNumber),
+		"-hls_time", strconv.Itoa(segmentDuration),
+		"-hls_list_size", "10",
+		"-hls_flags", flags,
+		"-hls_segment_type", segmentType,
+		"-hls_segment_filename", t.outputPath(varient, "%03d"+segmentExtension(segmentType)),
+	}
+	options = append(options, ingestOptions()...)
+	if segmentType == "fmp4" {
+		options = append(options, "-hls_fmp4_init_filename", "init.mp4")
+	}
+	return append(options, "-f", "hls")
 }
 
 func (t *Transcoder) prepareOutputDir() {
@@ -241,8 +577,17 @@ func (t *Transcoder) prepareOutputDir() {
 	t.OutputDir = path.Join(wd, config.GetConfig("").Config.Output.Dirname, t.ID)
 	zap.S().Infof("setting up output dir: %s", t.OutputDir)
 
-	for _, varient := range t.Varients {
-		varientPath := path.Join(t.OutputDir, varient)
+	renditions := t.videoVarients()
+	for _, codec := range t.audioCodecs() {
+		for i := range t.audioTracks() {
+			renditions = append(renditions, audioRendition(codec, i))
+		}
+	}
+	for i := range t.SubtitleTracks {
+		renditions = append(renditions, subtitleRendition(i))
+	}
+	for _, rendition := range renditions {
+		varientPath := path.Join(t.OutputDir, rendition)
 		err := os.MkdirAll(varientPath, os.ModePerm)
 		if err != nil {
 			zap.S().Warnf("transcoder: failed to mkdir, Error: %s", err)
@@ -250,17 +595,71 @@ func (t *Transcoder) prepareOutputDir() {
 	}
 }
 
-func (t *Transcoder) generateMasterHls() (m3u8.MasterPlaylist, error) {
+// masterPlaylist builds the master playlist, every URI prefixed by uriPrefix.
+// Video variants refer to the audio renditions through an EXT-X-MEDIA group,
+// and are listed once per audio codec so players pick the codec they support.
+// Without video, each audio codec gets a single audio-only variant.
+func (t *Transcoder) masterPlaylist(uriPrefix string) *m3u8.MasterPlaylist {
 	masterHls := m3u8.NewMasterPlaylist()
 
-	for _, varient := range t.Varients {
-		genrateVarient := m3u8.Variant{
-			URI:           fmt.Sprintf("%s/%s.m3u8", varient, varient),
-			VariantParams: t.getVideoMeatadata(varient),
+	subtitles := t.subtitleAlternatives(uriPrefix)
+	if len(t.Captions) > 0 {
+		masterHls.SetCustomTag(closedCaptionsTag{channels: t.Captions})
+	}
+
+	// withTextTracks attaches the subtitle and caption groups to a variant
+	withTextTracks := func(params m3u8.VariantParams) m3u8.VariantParams {
+		if len(subtitles) > 0 {
+			params.Subtitles = subtitlesGroupID
+			params.Alternatives = append(params.Alternatives, subtitles...)
+		}
+		if len(t.Captions) > 0 {
+			params.Captions = captionsGroupID
 		}
-		masterHls.Variants = append(masterHls.Variants, &genrateVarient)
+		return params
 	}
 
+	if !t.audioEnabled() {
+		for _, varient := range t.videoVarients() {
+			params := t.getVideoMeatadata(varient)
+			params.Codecs = codecs.Join(params.Codecs, t.AudioCodec.StringFourCC())
+			masterHls.Append(fmt.Sprintf("%s%s/%s.m3u8", uriPrefix, varient, varient), nil, withTextTracks(params))
+		}
+		return masterHls
+	}
+
+	for _, codec := range t.audioCodecs() {
+		alternatives := t.audioAlternatives(codec, uriPrefix)
+		if len(t.videoVarients()) == 0 {
+			// an audio-only stream, its variant plays the default rendition
+			params := m3u8.VariantParams{
+				Bandwidth:    uint32(codec.bitrate()) * 1000,
+				Codecs:       codec.StringFourCC(),
+				Audio:        audioGroupID(codec),
+				Alternatives: append([]*m3u8.Alternative(nil), alternatives...),
+			}
+			if len(subtitles) > 0 {
+				params.Subtitles = subtitlesGroupID
+				params.Alternatives = append(params.Alternatives, subtitles...)
+			}
+			masterHls.Append(defaultAlternative(alternatives).URI, nil, params)
+			continue
+		}
+		for _, varient := range t.videoVarients() {
+			params := t.getVideoMeatadata(varient)
+			params.Codecs = codecs.Join(params.Codecs, codec.StringFourCC())
+			params.Audio = audioGroupID(codec)
+			params.Alternatives = append([]*m3u8.Alternative(nil), alternatives...)
+			params.Bandwidth += uint32(codec.bitrate()) * 1000
+			masterHls.Append(fmt.Sprintf("%s%s/%s.m3u8", uriPrefix, varient, varient), nil, withTextTracks(params))
+		}
+	}
+	return masterHls
+}
+
+func (t *Transcoder) generateMasterHls() (m3u8.MasterPlaylist, error) {
+	masterHls := t.masterPlaylist("")
+
 	zap.S().Infof("transcoder, generated master.m3u8 hls file, %s", masterHls.String())
 	masterfilepath := path.Join(t.OutputDir, t.MasterFileName)
 	t.MasterHls = masterfilepath
@@ -274,6 +673,13 @@ func (t *Transcoder) writeFile(filepath string, data []byte) error {
 }
 
 func (t *Transcoder) getVideoMeatadata(varient string) m3u8.VariantParams {
+	metadata := t.varientParams(varient)
+	metadata.Codecs = t.videoEncoder().CodecString(t.rendition(varient))
+	return metadata
+}
+
+// varientParams returns the ladder entry of a varient, without codecs.
+func (t *Transcoder) varientParams(varient string) m3u8.VariantParams {
 	ONEKBPS := uint32(1000)
 
 	videoVarients := map[string]m3u8.VariantParams{
@@ -281,7 +687,6 @@ func (t *Transcoder) getVideoMeatadata(varient string) m3u8.VariantParams {
 			ProgramId:  1,
 			Resolution: "426x240",
 			Name:       "240p",
-			Codecs:     t.VideoCodec.StringFourCC(),
 			Bandwidth:  500 * ONEKBPS,
 			FrameRate:  t.FrameRate,
 		},
@@ -289,7 +694,6 @@ func (t *Transcoder) getVideoMeatadata(varient string) m3u8.VariantParams {
 			ProgramId:  2,
 			Resolution: "640x360",
 			Name:       "360p",
-			Codecs:     t.VideoCodec.StringFourCC(),
 			Bandwidth:  1200 * ONEKBPS,
 			FrameRate:  t.FrameRate,
 		},
@@ -297,7 +701,6 @@ func (t *Transcoder) getVideoMeatadata(varient string) m3u8.VariantParams {
 			ProgramId:  3,
 			Resolution: "854x480",
 			Name:       "480p",
-			Codecs:     t.VideoCodec.StringFourCC(),
 			Bandwidth:  3000 * ONEKBPS,
 			FrameRate:  t.FrameRate,
 		},
@@ -305,15 +708,13 @@ func (t *Transcoder) getVideoMeatadata(varient string) m3u8.VariantParams {
 			ProgramId:  4,
 			Resolution: "1280x720",
 			Name:       "720p",
-			Codecs:     t.VideoCodec.StringFourCC(),
 			Bandwidth:  5000 * ONEKBPS,
 			FrameRate:  t.FrameRate,
 		},
 		"1080p": {
 			ProgramId:  5,
-			Resolution: "192x1080",
+			Resolution: "1920x1080",
 			Name:       "1080p",
-			Codecs:     t.VideoCodec.StringFourCC(),
 			Bandwidth:  7000 * ONEKBPS,
 			FrameRate:  t.FrameRate,
 		},
@@ -321,7 +722,6 @@ func (t *Transcoder) getVideoMeatadata(varient string) m3u8.VariantParams {
 			ProgramId:  6,
 			Resolution: "2560x1440",
 			Name:       "2K",
-			Codecs:     t.VideoCodec.StringFourCC(),
 			Bandwidth:  10000 * ONEKBPS,
 			FrameRate:  t.FrameRate,
 		},
@@ -329,31 +729,14 @@ func (t *Transcoder) getVideoMeatadata(varient string) m3u8.VariantParams {
 			ProgramId:  7,
 			Resolution: "3840x2160",
 			Name:       "4K",
-			Codecs:     t.VideoCodec.StringFourCC(),
 			Bandwidth:  15000 * ONEKBPS,
 			FrameRate:  t.FrameRate,
 		},
-		"audio": {
-			ProgramId: 8,
-			Name:      "audio",
-			Codecs:    t.AudioCodec.StringFourCC(),
-			Bandwidth: 192 * ONEKBPS,
-		},
-	}
-
-	for _, varientmd := range videoVarients {
-		if t.AudioEnable {
-			audio, ok := videoVarients["audio"]
-			if !ok {
-				zap.S().Warn("didnt get any audio meatdata")
-			}
-			varientmd.Audio = audio.Name //nolint:noused
-		}
 	}
 
 	metadata, found := videoVarients[varient]
 	if !found {
-		return videoVarients[DefaultResolution]
+		metadata = videoVarients[DefaultResolution]
 	}
 	return metadata
 }
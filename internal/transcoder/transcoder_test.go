@@ -0,0 +1,26 @@
+package transcoder
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/meanii/hlsproxy/internal/externalcmd"
+	"github.com/meanii/hlsproxy/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRestartsMetric(t *testing.T) {
+	tsc := NewTranscoder("rtmp://example.com/live/stream", "restarts")
+	defer metrics.ForgetStream(tsc.ID)
+	restarts := metrics.FfmpegRestarts.WithLabelValues(tsc.ID)
+
+	// switching sources restarts ffmpeg on purpose
+	tsc.onExit(externalcmd.ExitResult{Code: -1, Signal: "interrupt", Err: errors.New("signal: interrupt"), Requested: true})
+	if got := testutil.ToFloat64(restarts); got != 0 {
+		t.Errorf("ffmpeg_restarts_total = %v after a requested restart, want 0", got)
+	}
+	tsc.onExit(externalcmd.ExitResult{Code: 1, Err: errors.New("exit status 1")})
+	if got := testutil.ToFloat64(restarts); got != 1 {
+		t.Errorf("ffmpeg_restarts_total = %v after a crash, want 1", got)
+	}
+}
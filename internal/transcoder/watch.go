@@ -0,0 +1,121 @@
+package transcoder
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/meanii/hlsproxy/internal/events"
+	"github.com/meanii/hlsproxy/internal/metrics"
+)
+
+const watchInterval = 500 * time.Millisecond
+
+// watchPlaylists polls the rendition playlists ffmpeg writes to the output
+// directory and reports their segments the way the ingest endpoint does.
+func (t *Transcoder) watchPlaylists(ctx context.Context) {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	known := make(map[string][]string)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, rendition := range t.liveRenditions() {
+			name := rendition + "/" + rendition + ".m3u8"
+			data, err := os.ReadFile(path.Join(t.OutputDir, rendition, rendition+".m3u8"))
+			if err != nil {
+				continue
+			}
+			segments := playlistSegments(data)
+			if equalStrings(segments, known[rendition]) {
+				continue
+			}
+
+			listed := make(map[string]bool, len(segments))
+			for _, segment := range segments {
+				listed[segment] = true
+			}
+			previous := make(map[string]bool, len(known[rendition]))
+			for _, segment := range known[rendition] {
+				previous[segment] = true
+				if !listed[segment] {
+					events.Publish(events.Event{Type: events.SegmentDeleted, StreamID: t.ID, Data: map[string]any{"rendition": rendition, "name": rendition + "/" + segment}})
+				}
+			}
+			for _, segment := range segments {
+				if previous[segment] {
+					continue
+				}
+				var size int64
+				if info, err := os.Stat(path.Join(t.OutputDir, rendition, segment)); err == nil {
+					size = info.Size()
+				}
+				t.segmentProduced(rendition, rendition+"/"+segment, size)
+			}
+			known[rendition] = segments
+			t.pruneDisk(rendition, data)
+			events.Publish(events.Event{Type: events.PlaylistUpdated, StreamID: t.ID, Data: map[string]any{"rendition": rendition, "name": name}})
+		}
+
+		// nothing deletes the WebVTT segments the subtitle playlists drop
+		for i := range t.SubtitleTracks {
+			rendition := subtitleRendition(i)
+			data, err := os.ReadFile(path.Join(t.OutputDir, rendition, rendition+".m3u8"))
+			if err != nil {
+				continue
+			}
+			segments := playlistSegments(data)
+			if equalStrings(segments, known[rendition]) {
+				continue
+			}
+			known[rendition] = segments
+			t.pruneDisk(rendition, data)
+		}
+	}
+}
+
+// segmentProduced reports a new segment of a rendition.
+func (t *Transcoder) segmentProduced(rendition string, name string, size int64) {
+	events.Publish(events.Event{Type: events.SegmentCreated, StreamID: t.ID, Data: map[string]any{"rendition": rendition, "name": name, "size": size}})
+	metrics.Segments.WithLabelValues(t.ID, rendition).Inc()
+	metrics.SegmentBytes.WithLabelValues(t.ID, rendition).Add(float64(size))
+	if n, ok := segmentNumber(name); ok {
+		t.Mux.Lock()
+		if n >= t.nextSegment {
+			t.nextSegment = n + 1
+		}
+		t.Mux.Unlock()
+	}
+	t.segmentArrived(rendition)
+}
+
+// playlistSegments returns the segment URIs of a media playlist.
+func playlistSegments(playlist []byte) []string {
+	var segments []string
+	for _, line := range strings.Split(string(playlist), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			segments = append(segments, line)
+		}
+	}
+	return segments
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,282 @@
+package transcoder
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/meanii/hlsproxy/config"
+	"github.com/meanii/hlsproxy/internal/events"
+	"github.com/meanii/hlsproxy/internal/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	actionRestart = "restart"
+	actionDegrade = "degrade"
+	actionIgnore  = "ignore"
+
+	conditionStalled = "stalled"
+	conditionBlack   = "black"
+	conditionFreeze  = "freeze"
+	conditionSilence = "silence"
+
+	defaultStallTimeout   = 5 * segmentDuration * time.Second
+	defaultDetectDuration = 5 * time.Second
+	watchdogInterval      = 1 * time.Second
+)
+
+// detectorMarkers maps the log lines of ffmpeg's detectors to the start
+// and end of a condition.
+var detectorMarkers = []struct {
+	condition string
+	marker    string
+	start     bool
+}{
+	{conditionBlack, "lavfi.black_start", true},
+	{conditionBlack, "lavfi.black_end", false},
+	{conditionFreeze, "lavfi.freezedetect.freeze_start", true},
+	{conditionFreeze, "lavfi.freezedetect.freeze_end", false},
+	{conditionSilence, "silence_start:", true},
+	{conditionSilence, "silence_end:", false},
+}
+
+// watchdogPolicy is the watchdog configuration with defaults applied.
+type watchdogPolicy struct {
+	stallTimeout   time.Duration
+	onStall        string
+	detect         map[string]bool
+	detectDuration time.Duration
+	onDetect       string
+}
+
+func getWatchdogPolicy() watchdogPolicy {
+	cfg := config.GetConfig("").Config.Ffmpeg.Watchdog
+	policy := watchdogPolicy{
+		stallTimeout:   cfg.StallTimeout,
+		onStall:        parseAction(cfg.OnStall, actionRestart),
+		detect:         make(map[string]bool),
+		detectDuration: cfg.DetectDuration,
+		onDetect:       parseAction(cfg.OnDetect, actionDegrade),
+	}
+	if policy.stallTimeout <= 0 {
+		policy.stallTimeout = defaultStallTimeout
+	}
+	if policy.detectDuration <= 0 {
+		policy.detectDuration = defaultDetectDuration
+	}
+	for _, name := range cfg.Detect {
+		switch name {
+		case conditionBlack, conditionFreeze, conditionSilence:
+			policy.detect[name] = true
+		default:
+			zap.S().Warnf("transcoder: skipping unknown detector %s", name)
+		}
+	}
+	return policy
+}
+
+func parseAction(action string, fallback string) string {
+	switch action {
+	case actionRestart, actionDegrade, actionIgnore:
+		return action
+	}
+	return fallback
+}
+
+// detectorFilters returns the filter chains analysing the source with the
+// configured detectors, on their own branches ending in null sinks.
+// videoLabel is the split output reserved to the video detectors.
+func (t *Transcoder) detectorFilters(videoLabel string) []string {
+	policy := getWatchdogPolicy()
+	seconds := policy.detectDuration.Seconds()
+
+	var filters []string
+	var video []string
+	if policy.detect[conditionBlack] {
+		// the metadata filters log the start and end as they happen,
+		// blackdetect itself only logs once the black period ended
+		video = append(video, fmt.Sprintf("blackdetect=d=%g:pix_th=0.10", seconds),
+			"metadata=mode=print:key=lavfi.black_start", "metadata=mode=print:key=lavfi.black_end")
+	}
+	if policy.detect[conditionFreeze] {
+		video = append(video, fmt.Sprintf("freezedetect=n=-60dB:d=%g", seconds))
+	}
+	if len(video) > 0 && videoLabel != "" {
+		filters = append(filters, videoLabel+"scale=w=320:h=-2,"+strings.Join(video, ",")+",nullsink")
+	}
+
+	// mapping an audio stream the source lacks would fail ffmpeg
+	if tracks := t.audioTracks(); policy.detect[conditionSilence] && len(tracks) > 0 && t.sourceAudioStreams() > tracks[0].Index {
+		filters = append(filters, fmt.Sprintf("[0:a:%d]silencedetect=n=-50dB:d=%g,anullsink", tracks[0].Index, seconds))
+	}
+	return filters
+}
+
+// hasVideoDetectors reports whether the source video is analysed.
+func hasVideoDetectors() bool {
+	policy := getWatchdogPolicy()
+	return policy.detect[conditionBlack] || policy.detect[conditionFreeze]
+}
+
+// watchdog raises the stalled condition of live streams whose renditions
+// stopped getting segments, and the detected conditions lasting longer
+// than the detect duration.
+func (t *Transcoder) watchdog(ctx context.Context) {
+	policy := getWatchdogPolicy()
+	if len(policy.detect) > 0 && t.Logs != nil {
+		go t.followDetectors(ctx)
+	}
+
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !t.isLive() {
+			continue
+		}
+
+		now := time.Now()
+		t.Mux.RLock()
+		var stalled []string
+		for _, rendition := range t.liveRenditions() {
+			if now.Sub(t.lastSegments[rendition]) > policy.stallTimeout {
+				stalled = append(stalled, rendition)
+			}
+		}
+		var detected []string
+		for condition, since := range t.detected {
+			if _, raised := t.raised[condition]; !raised && now.Sub(since) >= policy.detectDuration {
+				detected = append(detected, condition)
+			}
+		}
+		_, wasStalled := t.raised[conditionStalled]
+		actedAt := t.stallActedAt
+		t.Mux.RUnlock()
+
+		switch {
+		case len(stalled) > 0 && !wasStalled:
+			t.raise(conditionStalled, policy.onStall, map[string]any{"renditions": stalled})
+		case len(stalled) > 0 && policy.onStall == actionRestart && now.Sub(actedAt) > policy.stallTimeout:
+			// still stalled after the restart
+			t.act(conditionStalled, actionRestart)
+		case len(stalled) == 0 && wasStalled:
+			t.clear(conditionStalled)
+		}
+
+		sort.Strings(detected)
+		for _, condition := range detected {
+			t.raise(condition, policy.onDetect, nil)
+		}
+	}
+}
+
+// followDetectors parses the detector lines of the ffmpeg log.
+func (t *Transcoder) followDetectors(ctx context.Context) {
+	_, lines, stop := t.Logs.Follow(0)
+	defer stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+			for _, m := range detectorMarkers {
+				if !strings.Contains(line.Text, m.marker) {
+					continue
+				}
+				if m.start {
+					t.Mux.Lock()
+					if _, ok := t.detected[m.condition]; !ok {
+						t.detected[m.condition] = line.Time
+					}
+					t.Mux.Unlock()
+				} else {
+					t.Mux.Lock()
+					delete(t.detected, m.condition)
+					t.Mux.Unlock()
+					t.clear(m.condition)
+				}
+				break
+			}
+		}
+	}
+}
+
+// raise records a condition and applies its action.
+func (t *Transcoder) raise(condition string, action string, data map[string]any) {
+	zap.S().Warnf("transcoder: stream %s is %s, action: %s", t.ID, condition, action)
+	t.Mux.Lock()
+	t.raised[condition] = action
+	t.Mux.Unlock()
+
+	if condition == conditionStalled {
+		events.Publish(events.Event{Type: events.SegmentStalled, StreamID: t.ID, Data: data})
+	}
+	if action != actionIgnore {
+		if data == nil {
+			data = make(map[string]any)
+		}
+		data["reason"] = condition
+		data["action"] = action
+		events.Publish(events.Event{Type: events.StreamDegraded, StreamID: t.ID, Data: data})
+	}
+	t.act(condition, action)
+}
+
+// act applies the action of a raised condition.
+func (t *Transcoder) act(condition string, action string) {
+	metrics.WatchdogActions.WithLabelValues(condition, action).Inc()
+	if action != actionRestart {
+		return
+	}
+	if condition == conditionStalled {
+		t.Mux.Lock()
+		t.stallActedAt = time.Now()
+		t.Mux.Unlock()
+	}
+	if cmd := t.Cmd(); cmd != nil {
+		zap.S().Warnf("transcoder: restarting ffmpeg of stream %s, it is %s", t.ID, condition)
+		cmd.Restart()
+	}
+}
+
+// clear forgets a raised condition.
+func (t *Transcoder) clear(condition string) {
+	t.Mux.Lock()
+	action, raised := t.raised[condition]
+	delete(t.raised, condition)
+	t.Mux.Unlock()
+	if !raised {
+		return
+	}
+
+	zap.S().Infof("transcoder: stream %s recovered from %s", t.ID, condition)
+	if action != actionIgnore {
+		events.Publish(events.Event{Type: events.StreamRecovered, StreamID: t.ID, Data: map[string]any{"reason": condition}})
+	}
+}
+
+// Degraded returns the conditions the stream is degraded by, sorted.
+func (t *Transcoder) Degraded() []string {
+	t.Mux.RLock()
+	defer t.Mux.RUnlock()
+	var conditions []string
+	for condition, action := range t.raised {
+		if action != actionIgnore {
+			conditions = append(conditions, condition)
+		}
+	}
+	sort.Strings(conditions)
+	return conditions
+}
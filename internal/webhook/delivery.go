@@ -0,0 +1,48 @@
+package webhook
+
+import (
+	"sync"
+	"time"
+
+	"github.com/meanii/hlsproxy/internal/events"
+)
+
+// deliveryLogSize is the number of deliveries kept per hook.
+const deliveryLogSize = 100
+
+// Delivery records the outcome of sending an event to a hook.
+type Delivery struct {
+	ID         string        `json:"id"`
+	Event      events.Type   `json:"event"`
+	StreamID   string        `json:"stream_id"`
+	Time       time.Time     `json:"time"`
+	Attempts   int           `json:"attempts"`
+	StatusCode int           `json:"status_code,omitempty"`
+	Delivered  bool          `json:"delivered"`
+	Error      string        `json:"error,omitempty"`
+	Duration   time.Duration `json:"duration"`
+}
+
+type deliveryLog struct {
+	mu         sync.Mutex
+	deliveries []Delivery
+}
+
+func newDeliveryLog() *deliveryLog {
+	return &deliveryLog{}
+}
+
+func (l *deliveryLog) add(d Delivery) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.deliveries = append(l.deliveries, d)
+	if len(l.deliveries) > deliveryLogSize {
+		l.deliveries = l.deliveries[len(l.deliveries)-deliveryLogSize:]
+	}
+}
+
+func (l *deliveryLog) list() []Delivery {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Delivery(nil), l.deliveries...)
+}
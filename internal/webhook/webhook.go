@@ -0,0 +1,264 @@
+// Package webhook notifies external endpoints of stream events.
+//
+// Every delivery is a POST of the JSON encoded events.Event. When a secret
+// is configured the X-Hlsproxy-Signature header carries
+// "t=<unix timestamp>,v1=<hex HMAC-SHA256 of "<timestamp>.<body>">".
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/meanii/hlsproxy/config"
+	"github.com/meanii/hlsproxy/internal/events"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultMaxRetries = 5
+	defaultTimeout    = 5 * time.Second
+	initialBackoff    = 1 * time.Second
+	maxBackoff        = 1 * time.Minute
+
+	queueSize        = 256
+	subscriberBuffer = 1024
+)
+
+// lifecycleEvents are sent to hooks without an event filter.
+var lifecycleEvents = []events.Type{
+	events.StreamCreated,
+	events.StreamLive,
+	events.StreamRestarted,
+	events.StreamFailed,
+	events.StreamStopped,
+	events.StreamDegraded,
+	events.StreamRecovered,
+	events.StreamSourceSwitched,
+	events.SegmentStalled,
+}
+
+// hook delivers the events of a single configured endpoint, one at a time
+// and in order.
+type hook struct {
+	cfg    config.WebhookConfig
+	events map[events.Type]bool
+	queue  chan events.Event
+	client *http.Client
+	log    *deliveryLog
+}
+
+// Dispatcher fans the events of the bus out to the configured hooks.
+type Dispatcher struct {
+	hooks []*hook
+}
+
+var instance *Dispatcher
+
+// Start delivers events to the webhooks configured in config.yaml until
+// ctx is done.
+func Start(ctx context.Context) *Dispatcher {
+	instance = New(config.GetConfig("").Config.Webhooks)
+	if len(instance.hooks) > 0 {
+		zap.S().Infof("webhook: notifying %d endpoints", len(instance.hooks))
+		go instance.Run(ctx)
+	}
+	return instance
+}
+
+// GetDispatcher returns the dispatcher started by Start, nil before it.
+func GetDispatcher() *Dispatcher {
+	return instance
+}
+
+// New allocates a Dispatcher for the given hooks.
+func New(hooks []config.WebhookConfig) *Dispatcher {
+	d := &Dispatcher{}
+	for _, cfg := range hooks {
+		if cfg.URL == "" {
+			continue
+		}
+		switch {
+		case cfg.MaxRetries == 0:
+			cfg.MaxRetries = defaultMaxRetries
+		case cfg.MaxRetries < 0:
+			// negative disables retries
+			cfg.MaxRetries = 0
+		}
+		if cfg.Timeout <= 0 {
+			cfg.Timeout = defaultTimeout
+		}
+
+		h := &hook{
+			cfg:    cfg,
+			events: make(map[events.Type]bool),
+			queue:  make(chan events.Event, queueSize),
+			client: &http.Client{Timeout: cfg.Timeout},
+			log:    newDeliveryLog(),
+		}
+		filter := lifecycleEvents
+		if len(cfg.Events) > 0 {
+			filter = filter[:0:0]
+			for _, name := range cfg.Events {
+				filter = append(filter, events.Type(name))
+			}
+		}
+		for _, t := range filter {
+			h.events[t] = true
+		}
+		d.hooks = append(d.hooks, h)
+	}
+	return d
+}
+
+// Run subscribes to the event bus and delivers until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ch, cancel := events.Subscribe(subscriberBuffer)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, h := range d.hooks {
+		wg.Add(1)
+		go func(h *hook) {
+			defer wg.Done()
+			h.run(ctx)
+		}(h)
+	}
+	defer wg.Wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-ch:
+			for _, h := range d.hooks {
+				if !h.events[e.Type] {
+					continue
+				}
+				select {
+				case h.queue <- e:
+				default:
+					zap.S().Warnf("webhook: queue of %s is full, dropping %s of stream %s", h.cfg.URL, e.Type, e.StreamID)
+				}
+			}
+		}
+	}
+}
+
+// Deliveries returns the latest deliveries of every hook by URL, newest last.
+func (d *Dispatcher) Deliveries() map[string][]Delivery {
+	deliveries := make(map[string][]Delivery, len(d.hooks))
+	for _, h := range d.hooks {
+		deliveries[h.cfg.URL] = append(deliveries[h.cfg.URL], h.log.list()...)
+	}
+	return deliveries
+}
+
+func (h *hook) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-h.queue:
+			h.deliver(ctx, e)
+		}
+	}
+}
+
+// deliver posts e, retrying with exponential backoff on network errors,
+// 429 and 5xx responses.
+func (h *hook) deliver(ctx context.Context, e events.Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		zap.S().Errorf("webhook: failed to encode %s, Error: %s", e.Type, err)
+		return
+	}
+
+	delivery := Delivery{ID: uuid.New().String(), Event: e.Type, StreamID: e.StreamID, Time: time.Now()}
+	for attempt := 0; ; attempt++ {
+		delivery.Attempts = attempt + 1
+		status, err := h.post(ctx, delivery.ID, e.Type, body)
+		delivery.StatusCode = status
+		delivery.Error = ""
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+
+		retry := err != nil || status == http.StatusTooManyRequests || status >= 500
+		if !retry {
+			delivery.Delivered = status < 300
+			if !delivery.Delivered {
+				delivery.Error = fmt.Sprintf("endpoint responded %d", status)
+			}
+			break
+		}
+		if attempt >= h.cfg.MaxRetries {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			delivery.Error = ctx.Err().Error()
+			h.log.add(delivery)
+			return
+		case <-time.After(backoff(attempt)):
+		}
+	}
+	delivery.Duration = time.Since(delivery.Time)
+	h.log.add(delivery)
+
+	if !delivery.Delivered {
+		zap.S().Warnf("webhook: failed to deliver %s of stream %s to %s after %d attempts, Error: %s",
+			e.Type, e.StreamID, h.cfg.URL, delivery.Attempts, delivery.Error)
+	}
+}
+
+func (h *hook) post(ctx context.Context, id string, eventType events.Type, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "hlsproxy-webhook")
+	req.Header.Set("X-Hlsproxy-Event", string(eventType))
+	req.Header.Set("X-Hlsproxy-Delivery", id)
+	if h.cfg.Secret != "" {
+		req.Header.Set("X-Hlsproxy-Signature", Sign(h.cfg.Secret, time.Now(), body))
+	}
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	return res.StatusCode, nil
+}
+
+// Sign returns the signature header of body sent at t.
+func Sign(secret string, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff returns the pause after the given failed attempt, starting at 0.
+func backoff(attempt int) time.Duration {
+	d := float64(initialBackoff) * math.Pow(2, float64(attempt))
+	if d > float64(maxBackoff) {
+		return maxBackoff
+	}
+	return time.Duration(d)
+}
@@ -0,0 +1,213 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meanii/hlsproxy/config"
+	"github.com/meanii/hlsproxy/internal/events"
+)
+
+// verify checks a signature header the way a receiving endpoint would.
+func verify(secret, header string, body []byte) bool {
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signature = value
+		}
+	}
+	if _, err := strconv.ParseInt(timestamp, 10, 64); err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + string(body)))
+	want := hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(signature), []byte(want))
+}
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"type":"stream.live"}`)
+	got := Sign("secret", time.Unix(1700000000, 0), body)
+	if !strings.HasPrefix(got, "t=1700000000,v1=") {
+		t.Errorf("Sign() = %q, want the t=1700000000 timestamp first", got)
+	}
+	if !verify("secret", got, body) {
+		t.Errorf("Sign() = %q doesn't verify", got)
+	}
+	if verify("other", got, body) {
+		t.Error("the signature verifies with another secret")
+	}
+	if verify("secret", got, []byte(`{"type":"stream.failed"}`)) {
+		t.Error("the signature verifies another body")
+	}
+}
+
+func TestDeliverSigned(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		headers http.Header
+		body    []byte
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		headers = r.Header.Clone()
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	d := New([]config.WebhookConfig{{URL: server.URL, Secret: "secret"}})
+	e := events.Event{Type: events.StreamLive, StreamID: "stream"}
+	d.hooks[0].deliver(context.Background(), e)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !verify("secret", headers.Get("X-Hlsproxy-Signature"), body) {
+		t.Errorf("signature %q doesn't verify the body %s", headers.Get("X-Hlsproxy-Signature"), body)
+	}
+	if got := headers.Get("X-Hlsproxy-Event"); got != string(events.StreamLive) {
+		t.Errorf("X-Hlsproxy-Event = %q, want %q", got, events.StreamLive)
+	}
+	var got events.Event
+	if err := json.Unmarshal(body, &got); err != nil || got.StreamID != "stream" {
+		t.Errorf("body = %s, want the event of stream", body)
+	}
+	deliveries := d.Deliveries()[server.URL]
+	if len(deliveries) != 1 || deliveries[0].ID != headers.Get("X-Hlsproxy-Delivery") {
+		t.Errorf("deliveries = %+v, want the one of X-Hlsproxy-Delivery", deliveries)
+	}
+}
+
+func TestDeliverRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxRetries int
+		// statuses are the responses in order, the last one repeating;
+		// none makes the endpoint unreachable
+		statuses      []int
+		wantAttempts  int
+		wantStatus    int
+		wantDelivered bool
+		wantError     string
+	}{
+		{name: "ok", maxRetries: 2, statuses: []int{200}, wantAttempts: 1, wantStatus: 200, wantDelivered: true},
+		{name: "client error", maxRetries: 2, statuses: []int{404}, wantAttempts: 1, wantStatus: 404, wantError: "endpoint responded 404"},
+		{name: "too many requests", maxRetries: 2, statuses: []int{429, 204}, wantAttempts: 2, wantStatus: 204, wantDelivered: true},
+		{name: "server error", maxRetries: 1, statuses: []int{503}, wantAttempts: 2, wantStatus: 503},
+		{name: "network error", maxRetries: 1, wantAttempts: 2, wantError: "connection refused"},
+		{name: "no retries", maxRetries: -1, statuses: []int{500}, wantAttempts: 1, wantStatus: 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// retries back off a second
+			t.Parallel()
+			var (
+				mu    sync.Mutex
+				calls int
+			)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				w.WriteHeader(tt.statuses[min(calls, len(tt.statuses)-1)])
+				calls++
+			}))
+			defer server.Close()
+			if tt.statuses == nil {
+				server.Close()
+			}
+
+			d := New([]config.WebhookConfig{{URL: server.URL, MaxRetries: tt.maxRetries}})
+			d.hooks[0].deliver(context.Background(), events.Event{Type: events.StreamFailed, StreamID: "stream"})
+
+			deliveries := d.Deliveries()[server.URL]
+			if len(deliveries) != 1 {
+				t.Fatalf("%d deliveries logged, want 1", len(deliveries))
+			}
+			got := deliveries[0]
+			if got.Attempts != tt.wantAttempts {
+				t.Errorf("Attempts = %d, want %d", got.Attempts, tt.wantAttempts)
+			}
+			if got.StatusCode != tt.wantStatus {
+				t.Errorf("StatusCode = %d, want %d", got.StatusCode, tt.wantStatus)
+			}
+			if got.Delivered != tt.wantDelivered {
+				t.Errorf("Delivered = %v, want %v", got.Delivered, tt.wantDelivered)
+			}
+			if tt.wantDelivered && got.Error != "" {
+				t.Errorf("Error = %q, want none", got.Error)
+			}
+			if !strings.Contains(got.Error, tt.wantError) {
+				t.Errorf("Error = %q, want %q", got.Error, tt.wantError)
+			}
+			if got.Event != events.StreamFailed || got.StreamID != "stream" {
+				t.Errorf("delivery of %s of stream %q, want %s of stream", got.Event, got.StreamID, events.StreamFailed)
+			}
+		})
+	}
+}
+
+func TestNewMaxRetries(t *testing.T) {
+	tests := []struct {
+		maxRetries int
+		want       int
+	}{
+		{maxRetries: 0, want: defaultMaxRetries},
+		{maxRetries: 3, want: 3},
+		{maxRetries: -1, want: 0},
+	}
+	for _, tt := range tests {
+		d := New([]config.WebhookConfig{{URL: "http://example.com/hook", MaxRetries: tt.maxRetries}})
+		if got := d.hooks[0].cfg.MaxRetries; got != tt.want {
+			t.Errorf("max_retries %d retries %d times, want %d", tt.maxRetries, got, tt.want)
+		}
+	}
+}
+
+func TestNewEvents(t *testing.T) {
+	d := New([]config.WebhookConfig{
+		{URL: ""},
+		{URL: "http://example.com/lifecycle"},
+		{URL: "http://example.com/segments", Events: []string{string(events.SegmentCreated)}},
+	})
+	if len(d.hooks) != 2 {
+		t.Fatalf("%d hooks, want 2: hooks without URL are skipped", len(d.hooks))
+	}
+	if lifecycle := d.hooks[0]; !lifecycle.events[events.StreamLive] || lifecycle.events[events.SegmentCreated] {
+		t.Errorf("hook without filter gets %v, want the lifecycle events", lifecycle.events)
+	}
+	if segments := d.hooks[1]; !segments.events[events.SegmentCreated] || segments.events[events.StreamLive] {
+		t.Errorf("hook filtering segment events gets %v", segments.events)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{attempt: 0, want: initialBackoff},
+		{attempt: 1, want: 2 * initialBackoff},
+		{attempt: 3, want: 8 * initialBackoff},
+		{attempt: 10, want: maxBackoff},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.attempt); got != tt.want {
+			t.Errorf("backoff(%d) = %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package shutdown
 import (
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 
 	"github.com/meanii/hlsproxy/config"
@@ -10,6 +11,19 @@ import (
 	"go.uber.org/zap"
 )
 
+var (
+	hooksMu sync.Mutex
+	hooks   []func()
+)
+
+// OnShutdown registers fn to run before the process exits on a signal,
+// e.g. to flush buffered telemetry.
+func OnShutdown(fn func()) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	hooks = append(hooks, fn)
+}
+
 func EnableGrafullyShutdown() {
 	s := make(chan os.Signal, 1)
 	signal.Notify(s, os.Interrupt)
@@ -17,18 +31,28 @@ func EnableGrafullyShutdown() {
 	go func() {
 		<-s
 		// killing all running processes, in order to avoid ghost processes
-		for _, cmd := range externalcmd.GloblaActiveCmds {
+		for _, cmd := range externalcmd.ActiveCmds() {
 			zap.S().Infof("closing httpproxy gracefully...\ncmdstring: %s", cmd.GetCmdString())
 			cmd.Close()
-			syscall.Kill(-cmd.GetProcess().Pid, syscall.SIGINT)
-			err := cmd.Process.Kill()
+			process := cmd.GetProcess()
+			if process == nil {
+				continue
+			}
+			syscall.Kill(-process.Pid, syscall.SIGINT)
+			err := process.Kill()
 			if err != nil {
-				zap.S().Infof("failed to kill :%s", cmd.GetProcess().Pid)
+				zap.S().Infof("failed to kill :%d", process.Pid)
 			}
-			zap.S().Infof("closed processid: %s", cmd.GetProcess().Pid)
+			zap.S().Infof("closed processid: %d", process.Pid)
 		}
 		// Removing output dir
 		os.RemoveAll(config.GetConfig("").Config.Output.Dirname)
+
+		hooksMu.Lock()
+		for _, fn := range hooks {
+			fn()
+		}
+		hooksMu.Unlock()
 		os.Exit(0)
 	}()
 }